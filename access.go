@@ -0,0 +1,99 @@
+/*
+ * Adam - Adam's a Data Access Manager
+ * Copyright (C) 2021 Nicolò Santamaria
+ *
+ * Adam is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Adam is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// statusRecorder records the status and the size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.size += int64(n)
+	return n, err
+}
+
+// Flush sends the buffered data to the client if the wrapped writer supports
+// it, so that the streamed responses aren't held back by the access log.
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		if s.status == 0 {
+			s.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+// Unwrap returns the wrapped writer so that the handlers can reach the
+// interfaces it implements other than http.Flusher.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// accessLog logs every request served by h along with the principal and the
+// client certificate subject of the client sending it.
+func accessLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			start   = time.Now()
+			rec     = &statusRecorder{ResponseWriter: w}
+			name    = "-"
+			subject = "-"
+		)
+
+		h.ServeHTTP(rec, r)
+
+		if p, err := authenticate(r); err == nil {
+			name = p.name
+		}
+		if s, ok := clientSubject(r); ok {
+			subject = s.String()
+		}
+
+		log.Printf(
+			"access: %s %s %s %s %d %d %s principal=%s subject=%s",
+			r.RemoteAddr,
+			r.Method,
+			r.URL.RequestURI(),
+			r.Proto,
+			rec.status,
+			rec.size,
+			time.Since(start).Round(time.Millisecond),
+			strconv.Quote(name),
+			strconv.Quote(subject),
+		)
+	})
+}
@@ -0,0 +1,101 @@
+/*
+ * Adam - Adam's a Data Access Manager
+ * Copyright (C) 2021 Nicolò Santamaria
+ *
+ * Adam is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Adam is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// anyPrincipal is the principal of the ACL rules applying to every client.
+const anyPrincipal = "*"
+
+// ACLRule represents a rule of the configuration file granting a principal
+// the given permissions on the paths under prefix.
+type ACLRule struct {
+	Principal   string   `toml:"principal"`
+	Prefix      string   `toml:"prefix"`
+	Permissions []string `toml:"permissions"`
+}
+
+type aclRule struct {
+	principal string
+	prefix    string
+	perm      Perm
+}
+
+// acl contains the rules loaded from the configuration file.
+var acl []aclRule
+
+// loadACL loads and validates the ACL rules of the configuration.
+func loadACL() error {
+	acl = nil
+
+	for _, r := range cfg.ACL {
+		if r.Principal == "" {
+			return fmt.Errorf("loadACL: missing principal for prefix %q", r.Prefix)
+		}
+
+		perm, err := parsePerm(r.Permissions)
+		if err != nil {
+			return fmt.Errorf("loadACL %s: %w", r.Principal, err)
+		}
+
+		acl = append(acl, aclRule{
+			principal: r.Principal,
+			prefix:    filepath.Clean(r.Prefix),
+			perm:      perm,
+		})
+	}
+	return nil
+}
+
+// can reports whether the principal is allowed to perform all the operations
+// in perm on path. The principals not mentioned by any ACL rule are limited
+// only by their own permissions, the others are granted on each path the
+// union of the permissions of the rules whose prefix contains it.
+func (p principal) can(perm Perm, path string) bool {
+	if p.perm&perm != perm {
+		return false
+	}
+
+	var (
+		granted    Perm
+		restricted bool
+		clean      = filepath.Clean(path)
+	)
+
+	// The ACL was checked when the pre-signed URL was made, the client is
+	// only kept within the path it was signed for.
+	if p.signed {
+		return p.target != "" && inTree(clean, p.target)
+	}
+
+	for _, r := range acl {
+		if r.principal != p.name && r.principal != anyPrincipal {
+			continue
+		}
+		restricted = true
+
+		if inTree(clean, r.prefix) {
+			granted |= r.perm
+		}
+	}
+	return !restricted || granted&perm == perm
+}
@@ -1,9 +1,33 @@
 package main
 
 import (
-	"github.com/stretchr/testify/assert"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 var (
@@ -18,7 +42,7 @@ var (
 func TestSaveData(t *testing.T) {
 	id := "randomID"
 
-	f, err := saveData(id, fnameID, data)
+	f, err := saveData(id, fnameID, testUpload(t, data))
 	assert.NoError(t, err)
 	assert.Equal(t, f.Sha256sum, sha256sum)
 
@@ -36,7 +60,7 @@ func TestSaveData(t *testing.T) {
 }
 
 func TestPut(t *testing.T) {
-	f, err := put(fname, data)
+	f, err := put(fname, testUpload(t, data))
 	assert.NoError(t, err)
 	assert.Equal(t, f.Sha256sum, sha256sum)
 
@@ -53,6 +77,10 @@ func TestPut(t *testing.T) {
 	h, err := ccHash.Get([]byte(fname))
 	assert.NoError(t, err)
 	assert.Equal(t, h, []byte(sha256sum))
+
+	i, err := findIDFromPath(fname)
+	assert.NoError(t, err)
+	assert.Equal(t, f.ID, i)
 }
 
 func TestMove(t *testing.T) {
@@ -71,6 +99,14 @@ func TestMove(t *testing.T) {
 	h, err := ccHash.Get([]byte(fname2))
 	assert.NoError(t, err)
 	assert.Equal(t, sha256sum, string(h))
+
+	i, err := findIDFromPath(fname2)
+	assert.NoError(t, err)
+	assert.Equal(t, string(id), i)
+
+	i, err = findIDFromPath(fname)
+	assert.NoError(t, err)
+	assert.Empty(t, i)
 }
 
 func TestDel(t *testing.T) {
@@ -90,20 +126,46 @@ func TestDel(t *testing.T) {
 	hash, err := ccHash.Get([]byte(fname2))
 	assert.NoError(t, err)
 	assert.Nil(t, hash)
+
+	i, err := findIDFromPath(fname2)
+	assert.NoError(t, err)
+	assert.Empty(t, i)
+}
+
+func TestSubtree(t *testing.T) {
+	var (
+		inside  = filepath.Join("subtree", "dir", "file.txt")
+		sibling = filepath.Join("subtree", "dirname", "file.txt")
+	)
+
+	f1, err := put(inside, testUpload(t, data))
+	assert.NoError(t, err)
+	f2, err := put(sibling, testUpload(t, data))
+	assert.NoError(t, err)
+
+	files, err := subtree(filepath.Join("subtree", "dir"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{inside: f1.ID}, files)
+
+	files, err = subtree("subtree")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{inside: f1.ID, sibling: f2.ID}, files)
+
+	assert.NoError(t, del("subtree"))
 }
 
 func TestRestore(t *testing.T) {
 	var files = []File{
-		{"test/file0.txt", "sha256sum", "test_id_0"},
-		{"test/file1.txt", "sha256sum", "test_id_1"},
-		{"test/file2.txt", "sha256sum", "test_id_2"},
-		{"test/file3.txt", "sha256sum", "test_id_3"},
-		{"test/file4.txt", "sha256sum", "test_id_4"},
-		{"test/file5.txt", "sha256sum", "test_id_5"},
-		{"test/file6.txt", "sha256sum", "test_id_6"},
-		{"test/file7.txt", "sha256sum", "test_id_7"},
-		{"test/file8.txt", "sha256sum", "test_id_8"},
-		{"test/file9.txt", "sha256sum", "test_id_9"},
+		{Path: "test/file0.txt", Sha256sum: "sha256sum", ID: "test_id_0"},
+		{Path: "test/file1.txt", Sha256sum: "sha256sum", ID: "test_id_1"},
+		{Path: "test/file2.txt", Sha256sum: "sha256sum", ID: "test_id_2"},
+		{Path: "test/file3.txt", Sha256sum: "sha256sum", ID: "test_id_3"},
+		{Path: "test/file4.txt", Sha256sum: "sha256sum", ID: "test_id_4"},
+		{Path: "test/file5.txt", Sha256sum: "sha256sum", ID: "test_id_5"},
+		{Path: "test/file6.txt", Sha256sum: "sha256sum", ID: "test_id_6"},
+		{Path: "test/file7.txt", Sha256sum: "sha256sum", ID: "test_id_7"},
+		{Path: "test/file8.txt", Sha256sum: "sha256sum", ID: "test_id_8"},
+		{Path: "test/file9.txt", Sha256sum: "sha256sum", ID: "test_id_9"},
 	}
 
 	errs := restore(files)
@@ -118,18 +180,1773 @@ func TestRestore(t *testing.T) {
 		assert.NoError(t, err)
 		assert.NotNil(t, hash)
 	}
+
+	// The IDs are validated like the paths.
+	errs = restore([]File{
+		{Path: "test/empty_id.txt", Sha256sum: "sha256sum"},
+		{Path: "test/nul_id.txt", Sha256sum: "sha256sum", ID: "test\x00id"},
+	})
+	if assert.Len(t, errs, 2) {
+		assert.Equal(t, http.StatusBadRequest, errs[0].status)
+		assert.Equal(t, http.StatusBadRequest, errs[1].status)
+	}
+	id, err := findIDFromPath("test/nul_id.txt")
+	assert.NoError(t, err)
+	assert.Empty(t, id)
+
+	// An ID can't be taken over from a file at another path.
+	moved := File{Path: "test/moved.txt", Sha256sum: "sha256sum", ID: "test_id_0"}
+	if errs := restore([]File{moved}); assert.Len(t, errs, 1) {
+		assert.Equal(t, http.StatusConflict, errs[0].status)
+	}
+	path, err := ccID.Get([]byte(moved.ID))
+	assert.NoError(t, err)
+	assert.Equal(t, files[0].Path, string(path))
+	hash, err := ccHash.Get([]byte(moved.Path))
+	assert.NoError(t, err)
+	assert.Nil(t, hash)
+}
+
+func TestTxnRollback(t *testing.T) {
+	key := []byte("txn_test_id")
+
+	err := update(func(tx *Txn) error {
+		tx.Put(ccID, key, []byte("txn/test.txt"))
+		tx.Rename(filepath.Join(cfg.BaseDir, "txn", "missing"), filepath.Join(cfg.BaseDir, "txn", "dest"))
+		return nil
+	})
+	assert.Error(t, err)
+
+	path, err := ccID.Get(key)
+	assert.NoError(t, err)
+	assert.Nil(t, path)
+}
+
+func TestReplayJournal(t *testing.T) {
+	key := []byte("replay_test_id")
+
+	j, err := openJournal([]txOp{{Kind: opPut, Store: "ids", Key: key, Val: []byte("replay/test.txt")}})
+	assert.NoError(t, err)
+	j.Close()
+
+	assert.NoError(t, replayJournal())
+
+	path, err := ccID.Get(key)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("replay/test.txt"), path)
+	assert.NoError(t, ccID.Del(key))
+
+	ok, err := exists(j.Name())
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestFsck(t *testing.T) {
+	var (
+		untracked = filepath.Join("fsck", "untracked.txt")
+		abs       = filepath.Join(cfg.BaseDir, untracked)
+	)
+
+	assert.NoError(t, os.MkdirAll(filepath.Dir(abs), 0755))
+	assert.NoError(t, os.WriteFile(abs, data, 0644))
+
+	r, err := fsck()
+	assert.NoError(t, err)
+	assert.Contains(t, r.Untracked, untracked)
+
+	assert.NoError(t, repair(r))
+
+	r, err = fsck()
+	assert.NoError(t, err)
+	assert.NotContains(t, r.Untracked, untracked)
+
+	h, err := ccHash.Get([]byte(untracked))
+	assert.NoError(t, err)
+	assert.Equal(t, sha256sum, string(h))
+
+	assert.NoError(t, del("fsck"))
+}
+
+func TestScrubber(t *testing.T) {
+	var (
+		good = filepath.Join("scrub", "good.txt")
+		bad  = filepath.Join("scrub", "bad.txt")
+	)
+
+	fgood, err := put(good, testUpload(t, data))
+	assert.NoError(t, err)
+	fbad, err := put(bad, testUpload(t, data))
+	assert.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(cfg.BaseDir, bad), []byte("rotten"), 0644)
+	assert.NoError(t, err)
+
+	s := &scrubber{rate: 1 << 20}
+	assert.NoError(t, s.step())
+
+	res, err := scrubResult(fgood.ID)
+	assert.NoError(t, err)
+	assert.True(t, res.OK)
+
+	res, err = scrubResult(fbad.ID)
+	assert.NoError(t, err)
+	assert.False(t, res.OK)
+	assert.True(t, res.current())
+	assert.Equal(t, sha256sum, res.Expected)
+
+	assert.NoError(t, del("scrub"))
+}
+
+func TestPutWithMeta(t *testing.T) {
+	var (
+		escaped = filepath.Join("with_meta", "escaped.txt")
+		// The content is the base64 of the test data with an escaped character.
+		body = `[
+			{"id": "with_meta_0", "path": "` + escaped + `", "content": "dGVzdCBk\u0059XRh", "extra": {"a": [1, "}"]}},
+			{"id": "with_meta_1", "path": "with_meta/missing.txt", "n": 1.5e3}
+		]`
+	)
+
+	req := httptest.NewRequest(http.MethodPost, "/put_with_meta", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	handlePutWithMeta(rec, req)
+
+	var res struct {
+		OK     bool   `json:"ok"`
+		Files  []File `json:"files"`
+		Errors []interface{}
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.False(t, res.OK)
+	assert.Len(t, res.Errors, 1)
+	assert.Equal(t, []File{{Path: escaped, Sha256sum: sha256sum, ID: "with_meta_0"}}, bare(res.Files...))
+
+	// The ID of the first file can't be reused at another path.
+	body = `[{"id": "with_meta_0", "path": "with_meta/other.txt", "content": "dGVzdCBkYXRh"}]`
+	rec = httptest.NewRecorder()
+	handlePutWithMeta(rec, httptest.NewRequest(http.MethodPost, "/put_with_meta", strings.NewReader(body)))
+	assert.Contains(t, rec.Body.String(), `"code":"conflict"`)
+	ok, err := exists(filepath.Join(cfg.BaseDir, "with_meta", "other.txt"))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	id, err := findIDFromPath(escaped)
+	assert.NoError(t, err)
+	assert.Equal(t, "with_meta_0", id)
+
+	// The invalid files don't prevent saving the following ones.
+	body = `[
+		{"id": "with_meta_2", "path": "with_meta/corrupt.txt", "content": "!!!!"},
+		{"id": "with_meta_3", "path": "with_meta/tags.txt", "tags": "a", "content": "dGVzdA=="},
+		{"id": "with_meta_4", "path": "with_meta/large.txt", "content": "dGVzdCBkYXRh"},
+		{"id": "with_meta_5", "path": "with_meta/valid.txt", "content": "dGVzdA=="}
+	]`
+	cfg.MaxUploadSize = 4
+	rec = httptest.NewRecorder()
+	handlePutWithMeta(rec, httptest.NewRequest(http.MethodPost, "/put_with_meta", strings.NewReader(body)))
+	cfg.MaxUploadSize = 0
+	var put PutResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &put))
+	if assert.Len(t, put.Errors, 3) {
+		assert.Equal(t, "with_meta/corrupt.txt", put.Errors[0].Path)
+		assert.Equal(t, "bad_request", put.Errors[0].Code)
+		assert.Equal(t, "with_meta/tags.txt", put.Errors[1].Path)
+		assert.Equal(t, "bad_request", put.Errors[1].Code)
+		assert.Equal(t, "with_meta/large.txt", put.Errors[2].Path)
+		assert.Equal(t, "too_large", put.Errors[2].Code)
+	}
+	if assert.Len(t, put.Files, 1) {
+		assert.Equal(t, "with_meta_5", put.Files[0].ID)
+	}
+
+	// A syntax error in the content stops the whole array.
+	body = `[
+		{"id": "with_meta_6", "path": "with_meta/syntax.txt", "content": "dGVz\qdA=="},
+		{"id": "with_meta_7", "path": "with_meta/after.txt", "content": "dGVzdA=="}
+	]`
+	rec = httptest.NewRecorder()
+	handlePutWithMeta(rec, httptest.NewRequest(http.MethodPost, "/put_with_meta", strings.NewReader(body)))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	id, err = findIDFromPath(filepath.Join("with_meta", "after.txt"))
+	assert.NoError(t, err)
+	assert.Empty(t, id)
+
+	assert.NoError(t, del("with_meta"))
+}
+
+func TestErrors(t *testing.T) {
+	var res Base
+
+	rec := httptest.NewRecorder()
+	handleGet(rec, httptest.NewRequest(http.MethodGet, "/get?id=missing", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Equal(t, "not_found", res.Code)
+
+	rec = httptest.NewRecorder()
+	handleDel(rec, httptest.NewRequest(http.MethodPost, "/del/missing", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, http.MethodGet, rec.Header().Get("Allow"))
+
+	_, err := put(filepath.Join("errors", "a.txt"), testUpload(t, data))
+	assert.NoError(t, err)
+	_, err = put(filepath.Join("errors", "b.txt"), testUpload(t, data))
+	assert.NoError(t, err)
+
+	err = move(filepath.Join("errors", "a.txt"), filepath.Join("errors", "b.txt"))
+	assert.Equal(t, http.StatusConflict, asError(err).Status)
+	err = del(filepath.Join("errors", "missing.txt"))
+	assert.Equal(t, http.StatusNotFound, asError(err).Status)
+
+	cfg.MaxUploadSize = 4
+	_, err = receive(bytes.NewReader(data))
+	cfg.MaxUploadSize = 0
+	assert.Equal(t, http.StatusRequestEntityTooLarge, asError(err).Status)
+
+	assert.NoError(t, del("errors"))
+}
+
+func TestDedup(t *testing.T) {
+	defer func(c Config) { cfg = c }(cfg)
+	cfg.Dedup = true
+
+	var (
+		cnt  = []byte("deduplicated content")
+		blob string
+	)
+
+	a, err := put(filepath.Join("dedup", "a"), testUpload(t, cnt))
+	assert.NoError(t, err)
+	b, err := put(filepath.Join("dedup", "b"), testUpload(t, cnt))
+	assert.NoError(t, err)
+	assert.Equal(t, a.Sha256sum, b.Sha256sum)
+
+	blob = blobPath(a.Sha256sum)
+	assert.True(t, sameFile(filepath.Join(cfg.BaseDir, a.Path), blob))
+	assert.True(t, sameFile(filepath.Join(cfg.BaseDir, b.Path), blob))
+	n, err := ccBlobs.Get([]byte(a.Sha256sum))
+	assert.NoError(t, err)
+	assert.Equal(t, "2", string(n))
+
+	// Moving keeps the link to the blob.
+	assert.NoError(t, move(b.Path, filepath.Join("dedup", "c")))
+	assert.True(t, sameFile(filepath.Join(cfg.BaseDir, "dedup", "c"), blob))
+
+	// Overwriting releases the old blob and leaves the other file untouched.
+	_, err = put(a.Path, testUpload(t, []byte("new content")))
+	assert.NoError(t, err)
+	n, err = ccBlobs.Get([]byte(a.Sha256sum))
+	assert.NoError(t, err)
+	assert.Equal(t, "1", string(n))
+	c, err := os.ReadFile(filepath.Join(cfg.BaseDir, "dedup", "c"))
+	assert.NoError(t, err)
+	assert.Equal(t, cnt, c)
+
+	// Overwriting with the same content keeps the blob.
+	_, err = put(filepath.Join("dedup", "c"), testUpload(t, cnt))
+	assert.NoError(t, err)
+	ok, err := exists(blob)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// The blob is removed along with the last file linked to it once purged
+	// from the trash.
+	assert.NoError(t, del("dedup"))
+	ok, err = exists(blob)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	testPurge(t, "dedup")
+	ok, err = exists(blob)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	n, err = ccBlobs.Get([]byte(a.Sha256sum))
+	assert.NoError(t, err)
+	assert.Nil(t, n)
+}
+
+func TestVersions(t *testing.T) {
+	defer func(c Config) { cfg = c }(cfg)
+	cfg.MaxVersions = 2
+
+	var fpath = filepath.Join("versions", "file.txt")
+
+	for _, cnt := range []string{"one", "two", "three", "four"} {
+		_, err := put(fpath, testUpload(t, []byte(cnt)))
+		assert.NoError(t, err)
+	}
+	id, err := findIDFromPath(fpath)
+	assert.NoError(t, err)
+
+	// Only the two most recent versions are kept.
+	vs, err := versions(id)
+	assert.NoError(t, err)
+	if assert.Len(t, vs, 2) {
+		assert.Equal(t, 2, vs[0].Version)
+		assert.Equal(t, 3, vs[1].Version)
+		assert.Equal(t, int64(len("three")), vs[1].Size)
+	}
+	ok, err := exists(versionPath(id, 1))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	rec := httptest.NewRecorder()
+	handleGet(rec, httptest.NewRequest(http.MethodGet, "/get?id="+id+"&version=2", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "two", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	handleGet(rec, httptest.NewRequest(http.MethodGet, "/get?id="+id+"&version=1", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	var res VersionsResponse
+	rec = httptest.NewRecorder()
+	handleVersions(rec, httptest.NewRequest(http.MethodGet, "/versions?id="+id, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Equal(t, fpath, res.Path)
+	assert.Len(t, res.Versions, 2)
+
+	// Rolling back makes the replaced content a new version.
+	rec = httptest.NewRecorder()
+	handleRollback(rec, httptest.NewRequest(http.MethodPost, "/rollback?id="+id+"&version=2", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	cnt, err := os.ReadFile(filepath.Join(cfg.BaseDir, fpath))
+	assert.NoError(t, err)
+	assert.Equal(t, "two", string(cnt))
+
+	vs, err = versions(id)
+	assert.NoError(t, err)
+	if assert.Len(t, vs, 2) {
+		assert.Equal(t, 4, vs[1].Version)
+	}
+
+	// The history follows the file when moved and is dropped on delete.
+	assert.NoError(t, move("versions", "versions2"))
+	vs, err = versions(id)
+	assert.NoError(t, err)
+	assert.Len(t, vs, 2)
+
+	assert.NoError(t, del("versions2"))
+	vs, err = versions(id)
+	assert.NoError(t, err)
+	assert.Empty(t, vs)
+	ok, err = exists(versionsDir(id))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestTrash(t *testing.T) {
+	defer func(c Config) { cfg = c }(cfg)
+	cfg.MaxVersions = 2
+
+	var fpath = filepath.Join("trash", "dir", "file.txt")
+
+	for _, cnt := range []string{"one", "two"} {
+		_, err := put(fpath, testUpload(t, []byte(cnt)))
+		assert.NoError(t, err)
+	}
+	id, err := findIDFromPath(fpath)
+	assert.NoError(t, err)
+
+	assert.NoError(t, del(filepath.Join("trash", "dir")))
+	i, err := findIDFromPath(fpath)
+	assert.NoError(t, err)
+	assert.Empty(t, i)
+
+	var res TrashResponse
+	rec := httptest.NewRecorder()
+	handleTrash(rec, httptest.NewRequest(http.MethodGet, "/trash", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	if !assert.NotEmpty(t, res.Entries) {
+		return
+	}
+	e := res.Entries[0]
+	assert.Equal(t, filepath.Join("trash", "dir"), e.Path)
+	if assert.Len(t, e.Files, 1) {
+		assert.Equal(t, id, e.Files[0].ID)
+		assert.Len(t, e.Files[0].Versions, 1)
+	}
+
+	// Restoring brings back the content, the ID and the versions.
+	rec = httptest.NewRecorder()
+	handleTrashRestore(rec, httptest.NewRequest(http.MethodPost, "/trash/restore?id="+e.ID, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	cnt, err := os.ReadFile(filepath.Join(cfg.BaseDir, fpath))
+	assert.NoError(t, err)
+	assert.Equal(t, "two", string(cnt))
+	i, err = findIDFromPath(fpath)
+	assert.NoError(t, err)
+	assert.Equal(t, id, i)
+	vs, err := versions(id)
+	assert.NoError(t, err)
+	assert.Len(t, vs, 1)
+
+	rec = httptest.NewRecorder()
+	handleTrashRestore(rec, httptest.NewRequest(http.MethodPost, "/trash/restore?id="+e.ID, nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// A path taken in the meantime isn't overwritten.
+	assert.NoError(t, del("trash"))
+	_, err = put(fpath, testUpload(t, data))
+	assert.NoError(t, err)
+	entries, err := trashEntries()
+	assert.NoError(t, err)
+	_, err = restoreTrash(entries[0].ID)
+	assert.Equal(t, http.StatusConflict, asError(err).Status)
+
+	// The expired entries are purged.
+	entries[0].Deleted = time.Now().AddDate(0, 0, -2)
+	b, err := json.Marshal(entries[0])
+	assert.NoError(t, err)
+	assert.NoError(t, ccTrash.Put([]byte(entries[0].ID), b))
+	cfg.TrashExpiry = 1
+	assert.NoError(t, expireTrash())
+	old, err := trashEntry(entries[0].ID)
+	assert.NoError(t, err)
+	assert.Nil(t, old)
+	ok, err := exists(trashDir(entries[0].ID))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// The entries of large directories fit in the cache.
+	for i := 0; i < 600; i++ {
+		_, err := put(filepath.Join("trash", "many", fmt.Sprintf("%04d.txt", i)), testUpload(t, data))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, del(filepath.Join("trash", "many")))
+	testPurge(t, filepath.Join("trash", "many"))
+
+	assert.NoError(t, del("trash"))
+	testPurge(t, "trash")
+}
+
+func TestSnapshot(t *testing.T) {
+	var (
+		fpath = filepath.Join("snap", "file.txt")
+		other = filepath.Join("snap", "other.txt")
+	)
+
+	f, err := put(fpath, testUpload(t, []byte("before")))
+	assert.NoError(t, err)
+
+	// More files than a batch, including the ones unknown to Adam.
+	raw := filepath.Join(cfg.BaseDir, "snap", "raw")
+	assert.NoError(t, os.MkdirAll(raw, 0755))
+	for i := 0; i < 300; i++ {
+		assert.NoError(t, os.WriteFile(filepath.Join(raw, fmt.Sprint(i)), []byte("raw"), 0644))
+	}
+
+	s, err := createSnapshot("before-migration")
+	assert.NoError(t, err)
+	assert.Contains(t, s.Files, f)
+	assert.GreaterOrEqual(t, s.Size, int64(300*len("raw")))
+	cnt, err := os.ReadFile(filepath.Join(snapshotTree(s.Name), "snap", "raw", "299"))
+	assert.NoError(t, err)
+	assert.Equal(t, "raw", string(cnt))
+	_, err = createSnapshot("before-migration")
+	assert.Equal(t, http.StatusConflict, asError(err).Status)
+	_, err = createSnapshot("../escape")
+	assert.Equal(t, http.StatusBadRequest, asError(err).Status)
+
+	_, err = put(fpath, testUpload(t, []byte("after")))
+	assert.NoError(t, err)
+	_, err = put(other, testUpload(t, data))
+	assert.NoError(t, err)
+
+	// The snapshot keeps the old content, by ID and by path.
+	rec := httptest.NewRecorder()
+	handleSnapshots(rec, httptest.NewRequest(http.MethodGet, "/snapshots/before-migration?id="+f.ID, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "before", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	handleSnapshots(rec, httptest.NewRequest(http.MethodGet, "/snapshots/before-migration/snap/file.txt", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "before", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	handleSnapshots(rec, httptest.NewRequest(http.MethodGet, "/snapshots/before-migration/snap/other.txt", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	var res SnapshotsResponse
+	rec = httptest.NewRecorder()
+	handleSnapshots(rec, httptest.NewRequest(http.MethodGet, "/snapshots", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	if assert.Len(t, res.Snapshots, 1) {
+		assert.Equal(t, "before-migration", res.Snapshots[0].Name)
+		assert.Nil(t, res.Snapshots[0].Files)
+	}
+
+	// Restoring brings back the old content and IDs and drops the newer
+	// files, it requires an admin key.
+	rec = httptest.NewRecorder()
+	handleSnapshots(rec, httptest.NewRequest(http.MethodPost, "/snapshots/before-migration/restore", nil))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	perm, err := parsePerm([]string{"admin"})
+	assert.NoError(t, err)
+	admin, _, err := createKey("test_snapshots", perm)
+	assert.NoError(t, err)
+	defer revokeKey("test_snapshots")
+
+	req := httptest.NewRequest(http.MethodPost, "/snapshots/before-migration/restore", nil)
+	req.Header.Set("X-Api-Key", admin)
+	rec = httptest.NewRecorder()
+	handleSnapshots(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	cnt, err = os.ReadFile(filepath.Join(cfg.BaseDir, fpath))
+	assert.NoError(t, err)
+	assert.Equal(t, "before", string(cnt))
+	id, err := findIDFromPath(fpath)
+	assert.NoError(t, err)
+	assert.Equal(t, f.ID, id)
+	h, err := ccHash.Get([]byte(fpath))
+	assert.NoError(t, err)
+	assert.Equal(t, f.Sha256sum, string(h))
+	id, err = findIDFromPath(other)
+	assert.NoError(t, err)
+	assert.Empty(t, id)
+
+	// The replaced content is in a single trash entry, which can't be
+	// restored over the restored snapshot.
+	entries, err := trashEntries()
+	assert.NoError(t, err)
+	if assert.NotEmpty(t, entries) {
+		e := entries[0]
+		assert.Equal(t, ".", e.Path)
+		var paths []string
+		for _, f := range e.Files {
+			paths = append(paths, f.Path)
+		}
+		assert.Contains(t, paths, other)
+		cnt, err = os.ReadFile(e.content(other))
+		assert.NoError(t, err)
+		assert.Equal(t, string(data), string(cnt))
+
+		_, err = restoreTrash(e.ID)
+		assert.Equal(t, http.StatusConflict, asError(err).Status)
+	}
+
+	// The snapshot is left untouched by the writes on the restored files.
+	_, err = put(fpath, testUpload(t, []byte("again")))
+	assert.NoError(t, err)
+	cnt, err = os.ReadFile(filepath.Join(snapshotTree(s.Name), fpath))
+	assert.NoError(t, err)
+	assert.Equal(t, "before", string(cnt))
+
+	req = httptest.NewRequest(http.MethodDelete, "/snapshots/before-migration", nil)
+	req.Header.Set("X-Api-Key", admin)
+	rec = httptest.NewRecorder()
+	handleSnapshots(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	list, err := listSnapshots()
+	assert.NoError(t, err)
+	assert.Empty(t, list)
+
+	assert.NoError(t, del("snap"))
+}
+
+func TestStat(t *testing.T) {
+	f, err := put(filepath.Join("stat", "image.png"), testUpload(t, data))
+	assert.NoError(t, err)
+	if assert.NotNil(t, f.Stat) {
+		assert.Equal(t, int64(len(data)), f.Size)
+		assert.Equal(t, "image/png", f.MIME)
+		assert.Equal(t, f.Created, f.Modified)
+	}
+
+	// Without a known extension the type is detected from the content.
+	u := testUpload(t, []byte("<html><body>hello</body></html>"))
+	u.uploader = "tester"
+	g, err := put(filepath.Join("stat", "page"), u)
+	assert.NoError(t, err)
+	assert.Equal(t, "text/html", g.MIME)
+	assert.Equal(t, "tester", g.Uploader)
+
+	// Overwriting keeps the creation time.
+	g2, err := put(g.Path, testUpload(t, []byte("plain")))
+	assert.NoError(t, err)
+	assert.Equal(t, g.Created, g2.Created)
+	assert.True(t, g2.Modified.After(g.Modified))
+	assert.Equal(t, int64(len("plain")), g2.Size)
+
+	var res FileResponse
+	rec := httptest.NewRecorder()
+	handleStat(rec, httptest.NewRequest(http.MethodGet, "/stat/stat/image.png", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Equal(t, f, *res.File)
+
+	rec = httptest.NewRecorder()
+	handleStat(rec, httptest.NewRequest(http.MethodGet, "/stat?id="+g.ID, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Equal(t, g2, *res.File)
+
+	rec = httptest.NewRecorder()
+	handleStat(rec, httptest.NewRequest(http.MethodGet, "/stat/stat/missing", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// The Stat is restored along with the rest of the metadata.
+	restored := File{Path: filepath.Join("stat", "restored"), Sha256sum: sha256sum, ID: "stat_restored", Stat: f.Stat}
+	assert.Empty(t, restore([]File{restored}))
+	s, err := fileStat(restored.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, f.Stat, s)
+
+	assert.NoError(t, del("stat"))
+	s, err = fileStat(f.ID)
+	assert.NoError(t, err)
+	assert.Nil(t, s)
+}
+
+func TestMeta(t *testing.T) {
+	meta := func(method, id, body string) (*httptest.ResponseRecorder, File) {
+		var res FileResponse
+
+		rec := httptest.NewRecorder()
+		handleMeta(rec, httptest.NewRequest(method, "/meta?id="+id, strings.NewReader(body)))
+		if rec.Code == http.StatusOK {
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+			return rec, *res.File
+		}
+		return rec, File{}
+	}
+
+	u := testUpload(t, data)
+	u.meta = &Meta{Attrs: map[string]string{"owner": "alice"}, Tags: []string{"b", "a"}}
+	assert.NoError(t, u.meta.normalize())
+	f, err := put(filepath.Join("meta", "file.txt"), u)
+	assert.NoError(t, err)
+	assert.Equal(t, &Meta{Attrs: map[string]string{"owner": "alice"}, Tags: []string{"a", "b"}}, f.Meta)
+
+	// Overwriting without new metadata keeps the old one.
+	f, err = put(f.Path, testUpload(t, []byte("new")))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, f.Tags)
+
+	rec, g := meta(http.MethodPatch, f.ID, `{"attrs": {"owner": null, "k": "v"}, "add_tags": ["c", "a"], "remove_tags": ["b"]}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, &Meta{Attrs: map[string]string{"k": "v"}, Tags: []string{"a", "c"}}, g.Meta)
+
+	for _, body := range []string{`{"tags": [""]}`, `{"tags": ["a\u0000b"]}`, `{"attrs": {"a\u0000b": "v"}}`} {
+		rec, _ = meta(http.MethodPut, f.ID, body)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, body)
+	}
+	rec, _ = meta(http.MethodPatch, f.ID, `{"add_tags": ["a\u0000b"]}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec, _ = meta(http.MethodPut, "missing", `{}`)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec, g = meta(http.MethodPut, f.ID, `{"tags": ["x"]}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, &Meta{Tags: []string{"x"}}, g.Meta)
+
+	// The metadata follows the file when it's moved.
+	assert.NoError(t, move("meta", "meta_moved"))
+	rec, g = meta(http.MethodGet, f.ID, "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, filepath.Join("meta_moved", "file.txt"), g.Path)
+	assert.Equal(t, []string{"x"}, g.Tags)
+
+	rec, g = meta(http.MethodDelete, f.ID, "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Nil(t, g.Meta)
+
+	// Both the upload endpoints accept the metadata.
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("meta", `{"attrs": {"k": "v"}}`)
+	fw, err := mw.CreateFormFile("files[]", "form.txt")
+	assert.NoError(t, err)
+	fw.Write(data)
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/put/meta_moved", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec = httptest.NewRecorder()
+	handlePut(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	m, err := fileMeta(func() string {
+		id, err := findIDFromPath(filepath.Join("meta_moved", "form.txt"))
+		assert.NoError(t, err)
+		return id
+	}())
+	assert.NoError(t, err)
+	assert.Equal(t, &Meta{Attrs: map[string]string{"k": "v"}}, m)
+
+	rec = httptest.NewRecorder()
+	handlePutWithMeta(rec, httptest.NewRequest(http.MethodPost, "/put_with_meta", strings.NewReader(
+		`[{"id": "meta_json", "path": "meta_moved/json.txt", "tags": ["t"], "content": "dGVzdA=="}]`,
+	)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	m, err = fileMeta("meta_json")
+	assert.NoError(t, err)
+	assert.Equal(t, &Meta{Tags: []string{"t"}}, m)
+
+	// The metadata is dumped and restored along with the rest.
+	var res PutResponse
+	rec = httptest.NewRecorder()
+	handleGetMeta(rec, httptest.NewRequest(http.MethodGet, "/get_meta", nil))
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	var dumped *File
+	for i, f := range res.Files {
+		if f.ID == "meta_json" {
+			dumped = &res.Files[i]
+		}
+	}
+	if assert.NotNil(t, dumped) {
+		assert.Equal(t, m, dumped.Meta)
+	}
+
+	restored := File{Path: filepath.Join("meta_moved", "restored"), Sha256sum: sha256sum, ID: "meta_restored", Meta: m}
+	assert.Empty(t, restore([]File{restored}))
+	r, err := fileMeta(restored.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, m, r)
+
+	// Deleting a file drops its metadata.
+	assert.NoError(t, del("meta_moved"))
+	m, err = fileMeta("meta_json")
+	assert.NoError(t, err)
+	assert.Nil(t, m)
+	testPurge(t, "meta_moved")
+}
+
+func TestQuery(t *testing.T) {
+	query := func(params string) (int, QueryResponse) {
+		var res QueryResponse
+
+		rec := httptest.NewRecorder()
+		handleQuery(rec, httptest.NewRequest(http.MethodGet, "/query?"+params, nil))
+		if rec.Code == http.StatusOK {
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+		}
+		return rec.Code, res
+	}
+	paths := func(files []File) (res []string) {
+		for _, f := range files {
+			res = append(res, f.Path)
+		}
+		return
+	}
+
+	var (
+		big    = bytes.Repeat(data, 100)
+		tagged = &Meta{Tags: []string{"release"}}
+		start  = time.Now().UTC()
+	)
+	for _, f := range []struct {
+		path string
+		cnt  []byte
+		meta *Meta
+	}{
+		{"query/assets/a.png", big, tagged},
+		{"query/assets/b.png", data, tagged},
+		{"query/assets/c.png", big, nil},
+		{"query/assets/d.txt", big, tagged},
+		{"query/other/e.png", big, tagged},
+		{"query/assets2/f.png", big, tagged},
+	} {
+		u := testUpload(t, f.cnt)
+		u.meta = f.meta
+		_, err := put(f.path, u)
+		assert.NoError(t, err)
+	}
+
+	code, res := query("prefix=query/assets/&mime=image/png&min_size=100&tag=release")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"query/assets/a.png"}, paths(res.Files))
+	assert.Empty(t, res.Cursor)
+
+	code, res = query("glob=query/*/*.png&mime=image/*&sort=size&order=desc")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"query/other/e.png", "query/assets2/f.png", "query/assets/c.png", "query/assets/a.png", "query/assets/b.png"}, paths(res.Files))
+
+	code, res = query("prefix=query/&sha256sum=" + sha256sum + "&modified_after=" + start.Format(time.RFC3339Nano))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"query/assets/b.png"}, paths(res.Files))
+
+	code, res = query("prefix=query/&created_before=" + start.Format(time.RFC3339Nano))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, res.Files)
+
+	// The prefix stands for a directory or a file, not for any path starting
+	// with it.
+	for _, params := range []string{"prefix=query/assets", "prefix=query/assets&sort=size", "prefix=query/assets&tag=release&min_size=1"} {
+		code, res = query(params)
+		assert.Equal(t, http.StatusOK, code)
+		assert.NotContains(t, paths(res.Files), "query/assets2/f.png", params)
+		assert.Contains(t, paths(res.Files), "query/assets/a.png", params)
+	}
+	var walked []string
+	for cursor, i := "", 0; i < 10; i++ {
+		code, res = query("prefix=query/assets&limit=1&cursor=" + cursor)
+		assert.Equal(t, http.StatusOK, code)
+		walked = append(walked, paths(res.Files)...)
+		if cursor = res.Cursor; cursor == "" {
+			break
+		}
+	}
+	assert.Equal(t, []string{"query/assets/a.png", "query/assets/b.png", "query/assets/c.png", "query/assets/d.txt"}, walked)
+	code, res = query("prefix=query/assets2/f.png")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"query/assets2/f.png"}, paths(res.Files))
+
+	// The numbers sort like their encoding, the negative ones included.
+	nums := []int64{math.MinInt64, -1 << 40, -2, -1, 0, 1, 2, 1 << 40, math.MaxInt64}
+	for i := 1; i < len(nums); i++ {
+		assert.Less(t, number(nums[i-1]), number(nums[i]))
+	}
+
+	// The pages follow each other without gaps or duplicates.
+	var (
+		all    []string
+		cursor string
+	)
+	for i := 0; i < 10; i++ {
+		code, res = query("prefix=query/&tag=release&limit=2&cursor=" + cursor)
+		assert.Equal(t, http.StatusOK, code)
+		all = append(all, paths(res.Files)...)
+		if cursor = res.Cursor; cursor == "" {
+			break
+		}
+	}
+	assert.Equal(t, []string{"query/assets/a.png", "query/assets/b.png", "query/assets/d.txt", "query/assets2/f.png", "query/other/e.png"}, all)
+
+	// Without filters the pages walk all the paths in order.
+	all, cursor = nil, ""
+	for i := 0; i < 1000; i++ {
+		code, res = query("limit=2&cursor=" + cursor)
+		assert.Equal(t, http.StatusOK, code)
+		all = append(all, paths(res.Files)...)
+		if cursor = res.Cursor; cursor == "" {
+			break
+		}
+	}
+	var n int
+	assert.NoError(t, ccPath.Fold(func(_, _ []byte) error {
+		n++
+		return nil
+	}))
+	assert.Len(t, all, n)
+	assert.True(t, sort.StringsAreSorted(all))
+	assert.Subset(t, all, []string{"query/assets/a.png", "query/assets/b.png", "query/assets/c.png", "query/assets/d.txt", "query/other/e.png"})
+
+	// The index follows the changes of the metadata.
+	f, err := findIDFromPath("query/assets/c.png")
+	assert.NoError(t, err)
+	_, err = setMeta(f, func(*Meta) *Meta { return tagged })
+	assert.NoError(t, err)
+	assert.NoError(t, move("query/other", "query/moved"))
+	assert.NoError(t, del("query/assets/a.png"))
+	_, res = query("prefix=query/&tag=release&min_size=100")
+	assert.Equal(t, []string{"query/assets/c.png", "query/assets/d.txt", "query/assets2/f.png", "query/moved/e.png"}, paths(res.Files))
+
+	for _, params := range []string{"sort=name", "limit=0", "min_size=-1", "created_after=yesterday", "cursor=%21", "glob=["} {
+		code, _ := query(params)
+		assert.Equal(t, http.StatusBadRequest, code, params)
+	}
+
+	assert.NoError(t, del("query"))
+	testPurge(t, "query")
+	testPurge(t, "query/assets/a.png")
+	_, res = query("tag=release&prefix=query/")
+	assert.Empty(t, res.Files)
+}
+
+func TestGetMetaPages(t *testing.T) {
+	var ids []string
+	for i := 0; i < 5; i++ {
+		f, err := put(filepath.Join("pages", fmt.Sprintf("file%d.txt", i)), testUpload(t, data))
+		assert.NoError(t, err)
+		ids = append(ids, f.ID)
+	}
+	sort.Strings(ids)
+
+	// The pages list all the files in order of ID, among the other ones.
+	var (
+		paged  []string
+		cursor string
+	)
+	for i := 0; i < 1000; i++ {
+		var res MetaResponse
+
+		rec := httptest.NewRecorder()
+		handleGetMeta(rec, httptest.NewRequest(http.MethodGet, "/get_meta?limit=2&cursor="+cursor, nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+		assert.LessOrEqual(t, len(res.Files), 2)
+		for _, f := range res.Files {
+			if strings.HasPrefix(f.Path, "pages"+string(filepath.Separator)) {
+				paged = append(paged, f.ID)
+			}
+		}
+		if cursor = res.Cursor; cursor == "" {
+			break
+		}
+	}
+	assert.Equal(t, ids, paged)
+
+	rec := httptest.NewRecorder()
+	handleGetMeta(rec, httptest.NewRequest(http.MethodGet, "/get_meta?limit=0", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// The ndjson stream has a file on each line and it's flushed even
+	// through the access log.
+	rec = httptest.NewRecorder()
+	accessLog(http.HandlerFunc(handleGetMeta)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/get_meta?format=ndjson", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, ndjsonType, rec.Header().Get("Content-Type"))
+	assert.True(t, rec.Flushed)
+
+	var (
+		streamed []string
+		body     bytes.Buffer
+	)
+	for _, line := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n") {
+		var f File
+
+		assert.NoError(t, json.Unmarshal([]byte(line), &f))
+		if strings.HasPrefix(f.Path, "pages"+string(filepath.Separator)) {
+			streamed = append(streamed, f.ID)
+			// The stream is sent back to /set_meta under other paths.
+			f.ID += "_restored"
+			f.Path = strings.Replace(f.Path, "pages", "pages_restored", 1)
+			b, err := json.Marshal(f)
+			assert.NoError(t, err)
+			body.Write(append(b, '\n'))
+		}
+	}
+	sort.Strings(streamed)
+	assert.Equal(t, ids, streamed)
+
+	req := httptest.NewRequest(http.MethodPost, "/set_meta", &body)
+	req.Header.Set("Content-Type", ndjsonType)
+	rec = httptest.NewRecorder()
+	handleSetMeta(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"ok": true}`, rec.Body.String())
+
+	// The restored entries point to no content so they're only unindexed.
+	assert.NoError(t, update(func(tx *Txn) error {
+		for _, id := range ids {
+			path, err := tx.Get(ccID, []byte(id+"_restored"))
+			assert.NoError(t, err)
+			assert.True(t, strings.HasPrefix(string(path), "pages_restored"))
+			if err := unindexPath(tx, string(path), id+"_restored"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	assert.NoError(t, del("pages"))
+	testPurge(t, "pages")
+}
+
+func TestCacheSeek(t *testing.T) {
+	c, err := OpenCache(t.TempDir())
+	assert.NoError(t, err)
+	defer c.Close()
+
+	// Enough keys to fill more than one batch, stored out of order.
+	var keys []string
+	for i := 0; i < 1500; i++ {
+		k := fmt.Sprintf("key%04d", (i*7919)%1500)
+		assert.NoError(t, c.Put([]byte(k), []byte("v"+k)))
+		if i%3 != 0 {
+			keys = append(keys, k)
+		} else {
+			assert.NoError(t, c.Del([]byte(k)))
+		}
+	}
+	sort.Strings(keys)
+
+	seek := func(start string, n int) (res []string) {
+		err := c.Seek([]byte(start), func(k, v []byte) error {
+			assert.Equal(t, "v"+string(k), string(v))
+			if res = append(res, string(k)); len(res) == n {
+				return ErrIterationDone
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		return
+	}
+
+	assert.Equal(t, keys, seek("", -1))
+	i := sort.SearchStrings(keys, "key0700")
+	assert.Equal(t, keys[i:], seek("key0700", -1))
+	assert.Equal(t, keys[i+1:i+4], seek(keys[i]+"\x00", 3))
+	assert.Empty(t, seek("kez", -1))
+
+	// An empty prefix matches all the keys.
+	var n int
+	assert.NoError(t, c.Scan(nil, func(_, _ []byte) error {
+		n++
+		return nil
+	}))
+	assert.Equal(t, len(keys), n)
+}
+
+func TestCacheConcurrency(t *testing.T) {
+	c, err := OpenCache(t.TempDir())
+	assert.NoError(t, err)
+	defer c.Close()
+
+	// The caches are shared by all the handlers, the writers and the readers
+	// run at the same time.
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 300; i++ {
+				k := []byte(fmt.Sprintf("key%d_%04d", w, i))
+				assert.NoError(t, c.Put(k, k))
+				if i%2 == 0 {
+					assert.NoError(t, c.Del(k))
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				check := func(k, v []byte) error {
+					assert.Equal(t, k, v)
+					return nil
+				}
+				assert.NoError(t, c.Fold(check))
+				assert.NoError(t, c.Seek([]byte("key2"), check))
+				assert.NoError(t, c.Scan([]byte("key1_"), check))
+			}
+		}()
+	}
+	wg.Wait()
+
+	var keys []string
+	assert.NoError(t, c.Seek(nil, func(k, _ []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	}))
+	assert.Len(t, keys, 4*150)
+	assert.True(t, sort.StringsAreSorted(keys))
+}
+
+func TestPagesACL(t *testing.T) {
+	// Most of the files are hidden from the client, so the pages go through
+	// many of them, more than a batch of Cache.Seek, before filling up.
+	var team []File
+	for i := 0; i < 600; i++ {
+		_, err := put(filepath.Join("paging", "hidden", fmt.Sprintf("%04d.txt", i)), testUpload(t, data))
+		assert.NoError(t, err)
+		if i%100 == 0 {
+			f, err := put(filepath.Join("paging", "team", fmt.Sprintf("%04d.txt", i)), testUpload(t, data))
+			assert.NoError(t, err)
+			team = append(team, f)
+		}
+	}
+
+	perm, err := parsePerm([]string{"read"})
+	assert.NoError(t, err)
+	key, _, err := createKey("test_pager", perm)
+	assert.NoError(t, err)
+	defer revokeKey("test_pager")
+
+	cfg.ACL = []ACLRule{{Principal: "test_pager", Prefix: "paging/team", Permissions: []string{"read"}}}
+	assert.NoError(t, loadACL())
+	defer func() {
+		cfg.ACL = nil
+		loadACL()
+	}()
+
+	pages := func(h http.HandlerFunc, target string, field func(File) string) (res []string) {
+		var cursor string
+		for i := 0; i < 100; i++ {
+			var page QueryResponse
+
+			req := httptest.NewRequest(http.MethodGet, target+"&cursor="+cursor, nil)
+			req.Header.Set("X-Api-Key", key)
+			rec := httptest.NewRecorder()
+			h(rec, req)
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+			for _, f := range page.Files {
+				res = append(res, field(f))
+			}
+			if cursor = page.Cursor; cursor == "" {
+				break
+			}
+		}
+		return
+	}
+
+	var ids, paths []string
+	for _, f := range team {
+		ids = append(ids, f.ID)
+		paths = append(paths, f.Path)
+	}
+	sort.Strings(ids)
+
+	assert.Equal(t, ids, pages(handleGetMeta, "/get_meta?limit=2", func(f File) string { return f.ID }))
+	assert.Equal(t, paths, pages(handleQuery, "/query?limit=2", func(f File) string { return f.Path }))
+
+	assert.NoError(t, del("paging"))
+	testPurge(t, "paging")
+}
+
+func TestChanges(t *testing.T) {
+	start, err := lastSeq()
+	assert.NoError(t, err)
+
+	path := filepath.Join("changes", "file.txt")
+	f, err := put(path, testUpload(t, data))
+	assert.NoError(t, err)
+	_, err = put(path, testUpload(t, []byte("new")))
+	assert.NoError(t, err)
+	_, err = setMeta(f.ID, func(*Meta) *Meta { return &Meta{Tags: []string{"t"}} })
+	assert.NoError(t, err)
+	assert.NoError(t, move("changes", "changes_moved"))
+	moved := filepath.Join("changes_moved", "file.txt")
+	_, err = saveData("changes_other", moved, testUpload(t, data))
+	assert.NoError(t, err)
+	assert.NoError(t, del("changes_moved"))
+
+	changes := func(cursor uint64, limit int) ChangesResponse {
+		var res ChangesResponse
+
+		rec := httptest.NewRecorder()
+		handleChanges(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/changes?cursor=%d&limit=%d", cursor, limit), nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+		return res
+	}
+
+	// The changes are read a few at a time following the cursor.
+	var (
+		all    []Change
+		cursor = start
+	)
+	for {
+		res := changes(cursor, 3)
+		all = append(all, res.Changes...)
+		cursor = res.Cursor
+		if !res.More {
+			break
+		}
+	}
+
+	type op struct{ op, id, path string }
+	var ops []op
+	for i, c := range all {
+		assert.Equal(t, start+uint64(i)+1, c.Seq)
+		ops = append(ops, op{c.Op, c.ID, c.Path})
+	}
+	assert.Equal(t, []op{
+		{changePut, f.ID, path},
+		{changeOverwrite, f.ID, path},
+		{changeMeta, f.ID, path},
+		{changeMove, f.ID, moved},
+		{changeDelete, f.ID, moved},
+		{changePut, "changes_other", moved},
+		{changeDelete, "changes_other", moved},
+	}, ops)
+	assert.Equal(t, path, all[3].From)
+	assert.Equal(t, sha256sum, all[5].Sha256sum)
+
+	res := changes(cursor, 10)
+	assert.Empty(t, res.Changes)
+	assert.Equal(t, cursor, res.Cursor)
+	assert.False(t, res.More)
+
+	rec := httptest.NewRecorder()
+	handleChanges(rec, httptest.NewRequest(http.MethodGet, "/changes?cursor=-1", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	testPurge(t, "changes_moved")
+}
+
+func TestCleanTemp(t *testing.T) {
+	f, err := tempFile()
+	assert.NoError(t, err)
+	f.Close()
+
+	cleanTemp()
+
+	ok, err := exists(f.Name())
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestTus(t *testing.T) {
+	tus := func(method, path string, body []byte, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.Header.Set("Tus-Resumable", tusVersion)
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		rec := httptest.NewRecorder()
+		handleTus(rec, req)
+		return rec
+	}
+
+	meta := "path " + base64.StdEncoding.EncodeToString([]byte("tus/test.txt"))
+	rec := tus(http.MethodPost, "/tus/", nil, "Upload-Length", "9", "Upload-Metadata", meta)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	loc := rec.Header().Get("Location")
+
+	rec = tus(http.MethodPatch, loc, data[:4], "Content-Type", tusOctets, "Upload-Offset", "0")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "4", rec.Header().Get("Upload-Offset"))
+
+	rec = tus(http.MethodPatch, loc, data[4:], "Content-Type", tusOctets, "Upload-Offset", "0")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	rec = tus(http.MethodHead, loc, nil)
+	assert.Equal(t, "4", rec.Header().Get("Upload-Offset"))
+
+	rec = tus(http.MethodPatch, loc, data[4:], "Content-Type", tusOctets, "Upload-Offset", "4")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	rec = tus(http.MethodGet, loc, nil)
+	var res PutResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Len(t, res.Files, 1)
+	assert.Equal(t, sha256sum, res.Files[0].Sha256sum)
+
+	rec = tus(http.MethodDelete, loc, nil)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	rec = tus(http.MethodHead, loc, nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	meta = "path " + base64.StdEncoding.EncodeToString([]byte("tus/empty.txt"))
+	rec = tus(http.MethodPost, "/tus/", nil, "Upload-Length", "0", "Upload-Metadata", meta)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	b, err := os.ReadFile(filepath.Join(cfg.BaseDir, "tus", "empty.txt"))
+	assert.NoError(t, err)
+	assert.Empty(t, b)
+
+	assert.NoError(t, del("tus"))
+}
+
+func TestV1(t *testing.T) {
+	v1 := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleV1(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	var res FileResponse
+	rec := v1(http.MethodPut, "/v1/files/v1/test.txt", string(data))
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Equal(t, sha256sum, res.File.Sha256sum)
+	id := res.File.ID
+
+	rec = v1(http.MethodPut, "/v1/ids/"+id, string(data))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = v1(http.MethodHead, "/v1/files/v1/test.txt", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, id, rec.Header().Get("X-Adam-Id"))
+	assert.Equal(t, `"`+sha256sum+`"`, rec.Header().Get("ETag"))
+
+	rec = v1(http.MethodPatch, "/v1/ids/"+id, `{"path": "v1/moved.txt"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Equal(t, []File{{Path: "v1/moved.txt", Sha256sum: sha256sum, ID: id}}, bare(*res.File))
+
+	rec = v1(http.MethodGet, "/v1/ids/"+id, "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, data, rec.Body.Bytes())
+
+	rec = v1(http.MethodPost, "/v1/ids/"+id, "")
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	// The directories aren't listed.
+	rec = v1(http.MethodGet, "/v1/files/v1", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "moved.txt")
+
+	rec = v1(http.MethodDelete, "/v1/files/v1", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = v1(http.MethodGet, "/v1/ids/"+id, "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestSanitize(t *testing.T) {
+	var tests = []struct {
+		path   string
+		clean  string
+		status int
+	}{
+		{"dir/file.txt", filepath.Join("dir", "file.txt"), 0},
+		{"dir/../file.txt", "file.txt", 0},
+		{"./dir//file.txt", filepath.Join("dir", "file.txt"), 0},
+		{"", "", http.StatusBadRequest},
+		{".", "", http.StatusBadRequest},
+		{"dir/..", "", http.StatusBadRequest},
+		{"..", "", http.StatusBadRequest},
+		{"../file.txt", "", http.StatusBadRequest},
+		{"dir/../../file.txt", "", http.StatusBadRequest},
+		{"/etc/passwd", "", http.StatusBadRequest},
+		{`\\host\share`, "", http.StatusBadRequest},
+		{"file\x00.txt", "", http.StatusBadRequest},
+		{internalDir, "", http.StatusForbidden},
+		{filepath.Join(internalDir, "tmp", "file"), "", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		clean, err := sanitize(tt.path)
+		if tt.status == 0 {
+			assert.NoError(t, err, tt.path)
+			assert.Equal(t, tt.clean, clean, tt.path)
+		} else {
+			assert.Equal(t, tt.status, asError(err).Status, tt.path)
+		}
+	}
+}
+
+func TestSanitizeSymlinks(t *testing.T) {
+	var (
+		dir     = filepath.Join(cfg.BaseDir, "symlinks")
+		outside = t.TempDir()
+	)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "real"), 0755))
+	defer os.RemoveAll(dir)
+
+	if err := os.Symlink(outside, filepath.Join(dir, "out")); err != nil {
+		t.Skip("symbolic links not supported:", err)
+	}
+	assert.NoError(t, os.Symlink(filepath.Join(dir, "real"), filepath.Join(dir, "in")))
+	assert.NoError(t, os.Symlink(filepath.Join(dir, "missing"), filepath.Join(dir, "dangling")))
+
+	defer func(p string) { cfg.SymlinkPolicy = p }(cfg.SymlinkPolicy)
+
+	cfg.SymlinkPolicy = symlinksInside
+	_, err := sanitize(filepath.Join("symlinks", "in", "file.txt"))
+	assert.NoError(t, err)
+	_, err = sanitize(filepath.Join("symlinks", "out", "file.txt"))
+	assert.Equal(t, http.StatusForbidden, asError(err).Status)
+	_, err = sanitize(filepath.Join("symlinks", "dangling"))
+	assert.Equal(t, http.StatusForbidden, asError(err).Status)
+
+	cfg.SymlinkPolicy = symlinksDeny
+	_, err = sanitize(filepath.Join("symlinks", "in", "file.txt"))
+	assert.Equal(t, http.StatusForbidden, asError(err).Status)
+
+	cfg.SymlinkPolicy = symlinksFollow
+	_, err = sanitize(filepath.Join("symlinks", "out", "file.txt"))
+	assert.NoError(t, err)
+
+	cfg.SymlinkPolicy = symlinksInside
+	_, err = put(filepath.Join("symlinks", "out", "file.txt"), testUpload(t, data))
+	assert.Error(t, err)
+	ok, err := exists(filepath.Join(outside, "file.txt"))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestTraversal(t *testing.T) {
+	_, err := put("../escaped.txt", testUpload(t, data))
+	assert.Equal(t, http.StatusBadRequest, asError(err).Status)
+
+	assert.Error(t, del(""))
+	assert.Error(t, del(".."))
+	ok, err := exists(cfg.BaseDir)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	_, err = put(filepath.Join("traversal", "file.txt"), testUpload(t, data))
+	assert.NoError(t, err)
+	err = move(filepath.Join("traversal", "file.txt"), "../file.txt")
+	assert.Equal(t, http.StatusBadRequest, asError(err).Status)
+
+	body := `[{"id": "traversal_0", "path": "../../escaped.txt", "content": "dGVzdCBkYXRh"}]`
+	rec := httptest.NewRecorder()
+	handlePutWithMeta(rec, httptest.NewRequest(http.MethodPost, "/put_with_meta", strings.NewReader(body)))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handleSha256sum(rec, httptest.NewRequest(http.MethodGet, "/sha256sum/x/../../escaped.txt", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	errs := restore([]File{{Path: "/etc/passwd", ID: "traversal_1"}})
+	assert.Len(t, errs, 1)
+
+	// The names of the uploaded files can't leave the directory of the URL.
+	for _, name := range []string{"..", ".", "/"} {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, err := mw.CreateFormFile("files[]", name)
+		assert.NoError(t, err)
+		fw.Write(data)
+		mw.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/put/traversal/inner", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rec = httptest.NewRecorder()
+		handlePut(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, name)
+	}
+	ok, err = exists(filepath.Join(cfg.BaseDir, "traversal", "inner"))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.NoError(t, del("traversal"))
+}
+
+func TestAPIKeys(t *testing.T) {
+	get := func(key string) int {
+		req := httptest.NewRequest(http.MethodGet, "/get?id=missing", nil)
+		if key != "" {
+			req.Header.Set("X-Api-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		handleGet(rec, req)
+		return rec.Code
+	}
+
+	// Without keys authentication is disabled, but the first key can't be
+	// created anonymously.
+	assert.Equal(t, http.StatusNotFound, get(""))
+	rec := httptest.NewRecorder()
+	handleKeys(rec, httptest.NewRequest(http.MethodPost, "/keys", strings.NewReader(`{"name": "test_intruder", "permissions": ["admin"]}`)))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	_, err := parsePerm([]string{"read", "fly"})
+	assert.Error(t, err)
+
+	perm, err := parsePerm([]string{"write"})
+	assert.NoError(t, err)
+	writer, _, err := createKey("test_writer", perm)
+	assert.NoError(t, err)
+	perm, err = parsePerm([]string{"read", "admin"})
+	assert.NoError(t, err)
+	admin, _, err := createKey("test_admin", perm)
+	assert.NoError(t, err)
+	_, _, err = createKey("test_admin", perm)
+	assert.Equal(t, http.StatusConflict, asError(err).Status)
+
+	assert.Equal(t, http.StatusUnauthorized, get(""))
+	assert.Equal(t, http.StatusUnauthorized, get("invalid"))
+	assert.Equal(t, http.StatusForbidden, get(writer))
+	assert.Equal(t, http.StatusNotFound, get(admin))
+
+	req := httptest.NewRequest(http.MethodGet, "/keys", nil)
+	req.Header.Set("Authorization", "Bearer "+admin)
+	rec = httptest.NewRecorder()
+	handleKeys(rec, req)
+	var res KeysResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Len(t, res.Keys, 2)
+	assert.Equal(t, []string{"read", "admin"}, res.Keys[0].Permissions)
+
+	req = httptest.NewRequest(http.MethodDelete, "/keys/test_writer", nil)
+	req.Header.Set("X-Api-Key", writer)
+	rec = httptest.NewRecorder()
+	handleKeys(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	assert.NoError(t, revokeKey("test_writer"))
+	assert.NoError(t, revokeKey("test_admin"))
+	assert.Equal(t, http.StatusNotFound, asError(revokeKey("test_admin")).Status)
+	assert.Equal(t, http.StatusNotFound, get(""))
+}
+
+func TestACL(t *testing.T) {
+	perm, err := parsePerm([]string{"read", "write", "delete"})
+	assert.NoError(t, err)
+	key, _, err := createKey("test_team", perm)
+	assert.NoError(t, err)
+	defer revokeKey("test_team")
+
+	cfg.ACL = []ACLRule{
+		{Principal: "test_team", Prefix: "acl/team", Permissions: []string{"read", "write", "delete"}},
+		{Principal: "*", Prefix: "acl/public", Permissions: []string{"read"}},
+	}
+	assert.NoError(t, loadACL())
+	defer func() {
+		cfg.ACL = nil
+		loadACL()
+	}()
+
+	team := principal{name: "test_team", perm: perm}
+	assert.True(t, team.can(permWrite, filepath.Join("acl", "team", "file.txt")))
+	assert.True(t, team.can(permRead, filepath.Join("acl", "public", "file.txt")))
+	assert.False(t, team.can(permWrite, filepath.Join("acl", "public", "file.txt")))
+	assert.False(t, team.can(permRead, filepath.Join("acl", "teamB", "file.txt")))
+	assert.False(t, team.can(permRead, filepath.Join("acl", "team", "..", "other.txt")))
+	assert.False(t, team.can(permMove, filepath.Join("acl", "team", "file.txt")))
+
+	fteam, err := put(filepath.Join("acl", "team", "file.txt"), testUpload(t, data))
+	assert.NoError(t, err)
+	fother, err := put(filepath.Join("acl", "other", "file.txt"), testUpload(t, data))
+	assert.NoError(t, err)
+
+	request := func(h http.HandlerFunc, method, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("X-Api-Key", key)
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusOK, request(handleGet, http.MethodGet, "/get?id="+fteam.ID).Code)
+	assert.Equal(t, http.StatusForbidden, request(handleGet, http.MethodGet, "/get?id="+fother.ID).Code)
+	assert.Equal(t, http.StatusForbidden, request(handleDel, http.MethodGet, "/del/acl/other").Code)
+	assert.Equal(t, http.StatusForbidden, request(handleSha256sum, http.MethodGet, "/sha256sum/acl/other/file.txt").Code)
+
+	var res PutResponse
+	rec := request(handleGetMeta, http.MethodGet, "/get_meta")
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Equal(t, []File{fteam}, res.Files)
+
+	assert.Equal(t, http.StatusOK, request(handleDel, http.MethodGet, "/del/acl/team").Code)
+	assert.NoError(t, del("acl"))
+}
+
+func TestPresign(t *testing.T) {
+	cfg.URLSecret = "test secret"
+	defer func() { cfg.URLSecret = "" }()
+
+	f, err := put(filepath.Join("presign", "file.txt"), testUpload(t, data))
+	assert.NoError(t, err)
+
+	// The pre-signed URLs work without the key used to sign them.
+	perm, _ := parsePerm([]string{"read", "write"})
+	key, _, err := createKey("test_presign", perm)
+	assert.NoError(t, err)
+	defer revokeKey("test_presign")
+
+	presign := func(body string) string {
+		req := httptest.NewRequest(http.MethodPost, "/presign", strings.NewReader(body))
+		req.Header.Set("X-Api-Key", key)
+		rec := httptest.NewRecorder()
+		handlePresign(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var res PresignResponse
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+		return strings.TrimPrefix(res.URL, "http://example.com")
+	}
+
+	getURL := presign(`{"op": "get", "id": "` + f.ID + `"}`)
+	putURL := presign(`{"op": "put", "path": "presign/up", "max_size": 4, "content_type": "text/plain"}`)
+
+	rec := httptest.NewRecorder()
+	handleGet(rec, httptest.NewRequest(http.MethodGet, getURL, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, data, rec.Body.Bytes())
+
+	rec = httptest.NewRecorder()
+	handleGet(rec, httptest.NewRequest(http.MethodGet, strings.Replace(getURL, "expires=", "expires=1", 1), nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	upload := func(target, name, ctype string, cnt []byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+
+		mw := multipart.NewWriter(&body)
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", `form-data; name="files[]"; filename="`+name+`"`)
+		h.Set("Content-Type", ctype)
+		pw, err := mw.CreatePart(h)
+		assert.NoError(t, err)
+		pw.Write(cnt)
+		mw.Close()
+
+		req := httptest.NewRequest(http.MethodPost, target, &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rec := httptest.NewRecorder()
+		handlePut(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusOK, upload(putURL, "ok.txt", "text/plain", data[:4]).Code)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, upload(putURL, "big.txt", "text/plain", data).Code)
+	assert.Equal(t, http.StatusUnsupportedMediaType, upload(putURL, "img.png", "image/png", data[:4]).Code)
+	assert.Equal(t, http.StatusUnauthorized, upload(strings.Replace(putURL, "/up", "/other", 1), "ok.txt", "text/plain", data[:4]).Code)
+	assert.Equal(t, http.StatusBadRequest, upload(putURL, "..", "text/plain", data[:4]).Code)
+
+	// The signed principals are kept within their target.
+	p := principal{name: "presigned", perm: permWrite, signed: true, target: filepath.Join("presign", "up")}
+	assert.True(t, p.can(permWrite, filepath.Join("presign", "up", "ok.txt")))
+	assert.False(t, p.can(permWrite, "presign"))
+	assert.False(t, p.can(permWrite, filepath.Join("presign", "upper")))
+
+	assert.NoError(t, del("presign"))
+}
+
+func TestClientCert(t *testing.T) {
+	var (
+		ca, caKey      = testCert(t, "Test CA", nil, nil)
+		client, cliKey = testCert(t, "test_client", ca, caKey)
+		caPath         = filepath.Join(t.TempDir(), "ca.pem")
+	)
+
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+	assert.NoError(t, os.WriteFile(caPath, b, 0600))
+
+	defer func(c Config) { cfg = c }(cfg)
+	cfg.EnableTLS = true
+	cfg.ClientCA = caPath
+	cfg.ClientAuth = clientAuthRequire
+	cfg.ClientPrincipal = subjectCN
+	cfg.ClientPermissions = []string{"read"}
+	assert.NoError(t, loadClientAuth())
+
+	tlsCfg, err := tlsConfig()
+	assert.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := authenticate(r)
+		assert.NoError(t, err)
+		fmt.Fprint(w, p.name, " ", p.perm)
+	}))
+	srv.TLS = tlsCfg
+	srv.StartTLS()
+	defer srv.Close()
+
+	_, err = srv.Client().Get(srv.URL)
+	assert.Error(t, err)
+
+	c := srv.Client()
+	c.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{{
+		Certificate: [][]byte{client.Raw},
+		PrivateKey:  cliKey,
+	}}
+	res, err := c.Get(srv.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "test_client read", string(body))
+}
+
+func TestGenCert(t *testing.T) {
+	defer func(c Config) { cfg = c }(cfg)
+	cfg.CacheDir = t.TempDir()
+	cfg.AutoCert = true
+	cfg.TLSHosts = []string{"adam.test", "10.0.0.1"}
+
+	assert.NoError(t, ensureCert())
+	assert.Equal(t, filepath.Join(cfg.CacheDir, "cert.pem"), cfg.CertPath)
+
+	pair, err := tls.LoadX509KeyPair(cfg.CertPath, cfg.ServerKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	assert.NoError(t, err)
+	assert.NoError(t, cert.VerifyHostname("adam.test"))
+	assert.NoError(t, cert.VerifyHostname("10.0.0.1"))
+	assert.Error(t, cert.VerifyHostname("example.com"))
+
+	// The existing files are kept.
+	assert.NoError(t, ensureCert())
+	again, err := tls.LoadX509KeyPair(cfg.CertPath, cfg.ServerKey)
+	assert.NoError(t, err)
+	assert.Equal(t, pair.Certificate, again.Certificate)
+}
+
+// testCert returns a certificate for name signed by parent, or a self-signed
+// CA certificate if parent is nil.
+func testCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert, key
+}
+
+// bare returns the files without their Stat, which depends on when they were
+// stored.
+func bare(files ...File) []File {
+	for i := range files {
+		files[i].Stat = nil
+	}
+	return files
+}
+
+// testPurge permanently deletes the trash entries of the given path.
+func testPurge(t *testing.T, path string) {
+	entries, err := trashEntries()
+	assert.NoError(t, err)
+	for _, e := range entries {
+		if e.Path == path {
+			assert.NoError(t, purgeTrash(e.ID))
+		}
+	}
+}
+
+func testUpload(t *testing.T, cnt []byte) upload {
+	u, err := receive(bytes.NewReader(cnt))
+	assert.NoError(t, err)
+	return u
+}
+
+func TestInternalDir(t *testing.T) {
+	base := cfg.BaseDir
+	defer func() { cfg.BaseDir = base }()
+
+	// A directory left by an older version of Adam is adopted.
+	cfg.BaseDir = t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(cfg.BaseDir, internalDir, "trash"), 0755))
+	assert.NoError(t, checkInternalDir())
+	ok, err := exists(filepath.Join(cfg.BaseDir, internalDir, internalMarker))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// The content of the users is never hidden.
+	cfg.BaseDir = t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(cfg.BaseDir, internalDir, "trash"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(cfg.BaseDir, internalDir, "notes.txt"), data, 0644))
+	assert.Error(t, checkInternalDir())
+
+	cfg.BaseDir = t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(cfg.BaseDir, internalDir), data, 0644))
+	assert.Error(t, checkInternalDir())
 }
 
 func init() {
 	cfg = Config{
-		BaseDir:  filepath.Join(Home, ".adam_test"),
-		CacheDir: filepath.Join(Home, ".cache", "adam_test"),
-		Port:     ":8080",
+		BaseDir:       filepath.Join(Home, ".adam_test"),
+		CacheDir:      filepath.Join(Home, ".cache", "adam_test"),
+		Port:          ":8080",
+		UploadExpiry:  1,
+		SymlinkPolicy: symlinksInside,
 	}
 
 	createIfNotExists(cfg.BaseDir)
 	createIfNotExists(cfg.CacheDir)
+	if err := checkInternalDir(); err != nil {
+		panic(err)
+	}
 
-	ccHash = Cache(filepath.Join(cfg.CacheDir, "sha256sum"))
-	ccID = Cache(filepath.Join(cfg.CacheDir, "ids"))
+	if err := openCaches(); err != nil {
+		panic(err)
+	}
 }
@@ -0,0 +1,113 @@
+/*
+ * Adam - Adam's a Data Access Manager
+ * Copyright (C) 2021 Nicolò Santamaria
+ *
+ * Adam is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Adam is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// All the writes in the base directory go through a temporary file that is
+// flushed to disk and then renamed into place, so that readers never see a
+// partially written file and a crash never leaves a corrupted one.
+
+// mkdirAllSync is like os.MkdirAll but it also flushes the parent of each
+// directory it creates.
+func mkdirAllSync(dir string) error {
+	var created []string
+
+	for d := dir; ; d = filepath.Dir(d) {
+		if ok, err := exists(d); err != nil {
+			return err
+		} else if ok || d == filepath.Dir(d) {
+			break
+		}
+		created = append(created, d)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, d := range created {
+		if err := syncDir(filepath.Dir(d)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameSync renames from into to creating the missing parent directories of
+// to and flushes both the source and destination directories.
+func renameSync(from, to string) error {
+	if err := mkdirAllSync(filepath.Dir(to)); err != nil {
+		return err
+	}
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(to)); err != nil {
+		return err
+	}
+	if filepath.Dir(from) != filepath.Dir(to) {
+		return syncDir(filepath.Dir(from))
+	}
+	return nil
+}
+
+// linkSync creates the hard link to pointing to from, creating the missing
+// parent directories of to, and flushes the directory of to.
+func linkSync(from, to string) error {
+	if err := mkdirAllSync(filepath.Dir(to)); err != nil {
+		return err
+	}
+	if err := os.Link(from, to); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(to))
+}
+
+// removeSync removes path and all its children and flushes its parent.
+func removeSync(path string) error {
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// cleanTemp removes the temporary files left behind by a previous run,
+// it must be called after the journal has been replayed.
+func cleanTemp() {
+	dir := filepath.Join(cfg.BaseDir, internalDir, "tmp")
+
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("cleanTemp", "os.ReadDir", err)
+		return
+	}
+
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			log.Println("cleanTemp", "os.RemoveAll", err)
+		}
+	}
+	if len(entries) > 0 {
+		log.Printf("removed %d leftover temporary files", len(entries))
+	}
+}
@@ -23,35 +23,66 @@ package main
 
 import (
 	"errors"
+
 	"git.mills.io/prologic/bitcask"
 )
 
 // ErrIterationDone is useful to stop the iteration in the Fold function.
 var ErrIterationDone = errors.New("iteration done")
 
+// Paths are used as keys so bitcask's default limit of 64 bytes is too low.
+const maxKeySize = 4096
+
 // Cache is the abstraction object to the key-value database used for caching.
-type Cache string
+// The underlying database is kept open until Close is called and it's safe
+// for concurrent use.
+type Cache struct {
+	db   *bitcask.Bitcask
+	keys *keyIndex
+}
 
-// Put stores a value in the cache.
-func (c Cache) Put(key, val []byte) error {
-	cc, err := bitcask.Open(string(c))
+// OpenCache opens the cache at the given path creating it if it doesn't exist.
+func OpenCache(path string) (*Cache, error) {
+	var keys [][]byte
+
+	db, err := bitcask.Open(
+		path,
+		bitcask.WithMaxKeySize(maxKeySize),
+		// The trash entries list all the deleted files, so their size has
+		// no limit.
+		bitcask.WithMaxValueSize(0),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Fold(func(key []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
 	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Cache{db: db, keys: newKeyIndex(keys)}, nil
+}
+
+// Put stores a value in the cache.
+func (c *Cache) Put(key, val []byte) error {
+	c.keys.Lock()
+	defer c.keys.Unlock()
+
+	if err := c.db.Put(key, val); err != nil {
 		return err
 	}
-	defer cc.Close()
-	return cc.Put(key, val)
+	c.keys.insert(key)
+	return nil
 }
 
 // Get returns the value from the cache associated with the given key.
 // If no value is associated with the given key nil is returned.
-func (c Cache) Get(key []byte) ([]byte, error) {
-	cc, err := bitcask.Open(string(c))
-	if err != nil {
-		return []byte{}, err
-	}
-	defer cc.Close()
-
-	val, err := cc.Get(key)
+func (c *Cache) Get(key []byte) ([]byte, error) {
+	val, err := c.db.Get(key)
 	if errors.Is(err, bitcask.ErrKeyNotFound) {
 		return nil, nil
 	}
@@ -59,49 +90,82 @@ func (c Cache) Get(key []byte) ([]byte, error) {
 }
 
 // Del deletes the value in the cache that corresponds to the given key.
-func (c Cache) Del(key []byte) error {
-	cc, err := bitcask.Open(string(c))
-	if err != nil {
-		return err
-	}
-	defer cc.Close()
+func (c *Cache) Del(key []byte) error {
+	c.keys.Lock()
+	defer c.keys.Unlock()
 
-	err = cc.Delete(key)
-	if errors.Is(err, bitcask.ErrKeyNotFound) {
-		return nil
+	err := c.db.Delete(key)
+	if err != nil && !errors.Is(err, bitcask.ErrKeyNotFound) {
+		return err
 	}
-	return err
+	c.keys.remove(key)
+	return nil
 }
 
 // Fold iterates over all the key-value pairs stored in the cache and calls the
 // function in input passing those values as argument.
-func (c Cache) Fold(fn func(key, val []byte) error) (err error) {
-	cc, err := bitcask.Open(string(c))
+func (c *Cache) Fold(fn func(key, val []byte) error) error {
+	var keys [][]byte
+
+	// The keys are collected first since calling Get from within bitcask's
+	// Fold would take its read lock recursively and deadlock with writers.
+	err := c.db.Fold(func(key []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	defer cc.Close()
+	return c.each(keys, fn)
+}
 
-	err = cc.Fold(func(key []byte) error {
-		val, err := cc.Get(key)
-		if err != nil {
-			return err
-		}
+// Scan iterates over all the key-value pairs whose key starts with the given
+// prefix and calls the function in input passing those values as argument.
+func (c *Cache) Scan(prefix []byte, fn func(key, val []byte) error) error {
+	var keys [][]byte
 
-		return fn(key, val)
-	})
+	// Bitcask matches no key with an empty prefix.
+	if len(prefix) == 0 {
+		return c.Fold(fn)
+	}
 
-	if errors.Is(err, ErrIterationDone) {
+	err := c.db.Scan(prefix, func(key []byte) error {
+		keys = append(keys, key)
 		return nil
+	})
+	if err != nil {
+		return err
 	}
-	return err
+	return c.each(keys, fn)
 }
 
-func (c Cache) Merge() error {
-	cc, err := bitcask.Open(string(c))
-	if err != nil {
-		return err
+// each calls fn with each of the given keys and their value.
+func (c *Cache) each(keys [][]byte, fn func(key, val []byte) error) error {
+	for _, k := range keys {
+		val, err := c.db.Get(k)
+		if errors.Is(err, bitcask.ErrKeyNotFound) {
+			// The key has been deleted in the meantime.
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err := fn(k, val); err != nil {
+			if errors.Is(err, ErrIterationDone) {
+				return nil
+			}
+			return err
+		}
 	}
-	defer cc.Close()
-	return cc.Merge()
+	return nil
+}
+
+// Merge compacts the files of the underlying database.
+func (c *Cache) Merge() error {
+	return c.db.Merge()
+}
+
+// Close flushes and closes the underlying database.
+func (c *Cache) Close() error {
+	return c.db.Close()
 }
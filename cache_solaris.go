@@ -23,6 +23,7 @@ package main
 
 import (
 	"errors"
+
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
@@ -31,65 +32,89 @@ import (
 var ErrIterationDone = errors.New("iteration done")
 
 // Cache is the abstraction object to the key-value database used for caching.
-type Cache string
+// The underlying database is kept open until Close is called and it's safe
+// for concurrent use.
+type Cache struct {
+	db *leveldb.DB
+}
 
-// Put stores a value in the cache.
-func (c Cache) Put(key, val []byte) error {
-	cc, err := leveldb.OpenFile(string(c), nil)
+// OpenCache opens the cache at the given path creating it if it doesn't exist.
+func OpenCache(path string) (*Cache, error) {
+	db, err := leveldb.OpenFile(path, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer cc.Close()
-	return cc.Put(key, val, nil)
+	return &Cache{db: db}, nil
+}
+
+// Put stores a value in the cache.
+func (c *Cache) Put(key, val []byte) error {
+	return c.db.Put(key, val, nil)
 }
 
 // Get returns the value from the cache associated with the given key.
 // If no value is associated with the given key nil is returned.
-func (c Cache) Get(key []byte) ([]byte, error) {
-	cc, err := leveldb.OpenFile(string(c), nil)
-	if err != nil {
-		return []byte{}, err
+func (c *Cache) Get(key []byte) ([]byte, error) {
+	val, err := c.db.Get(key, nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, nil
 	}
-	defer cc.Close()
-	return cc.Get(key, nil)
+	return val, err
 }
 
 // Del deletes the value in the cache that corresponds to the given key.
-func (c Cache) Del(key []byte) error {
-	cc, err := leveldb.OpenFile(string(c), nil)
-	if err != nil {
-		return err
-	}
-	defer cc.Close()
-	return cc.Delete(key, nil)
+func (c *Cache) Del(key []byte) error {
+	return c.db.Delete(key, nil)
 }
 
 // Fold iterates over all the key-value pairs stored in the cache and calls the
 // function in input passing those values as argument.
-func (c Cache) Fold(fn func(key, val []byte) error) (err error) {
-	cc, err := leveldb.OpenFile(string(c), nil)
-	if err != nil {
-		return err
-	}
-	defer cc.Close()
+func (c *Cache) Fold(fn func(key, val []byte) error) error {
+	return c.iterate(nil, fn)
+}
+
+// Scan iterates over all the key-value pairs whose key starts with the given
+// prefix and calls the function in input passing those values as argument.
+func (c *Cache) Scan(prefix []byte, fn func(key, val []byte) error) error {
+	return c.iterate(util.BytesPrefix(prefix), fn)
+}
 
-	iter := cc.NewIterator(nil, nil)
+// Seek iterates in key order over the key-value pairs whose key isn't less
+// than start and calls the function in input passing those values as
+// argument.
+func (c *Cache) Seek(start []byte, fn func(key, val []byte) error) error {
+	return c.iterate(&util.Range{Start: start}, fn)
+}
+
+// iterate calls fn with each key-value pair in the given range.
+func (c *Cache) iterate(rng *util.Range, fn func(key, val []byte) error) (err error) {
+	iter := c.db.NewIterator(rng, nil)
+	defer iter.Release()
 
 	for iter.Next() {
-		if err := fn(iter.Key(), iter.Value()); err != nil {
+		// The iterator reuses its buffers so we pass copies to fn.
+		k := append([]byte{}, iter.Key()...)
+		v := append([]byte{}, iter.Value()...)
+
+		if err = fn(k, v); err != nil {
 			break
 		}
 	}
-	iter.Release()
 
+	if errors.Is(err, ErrIterationDone) {
+		return nil
+	} else if err != nil {
+		return err
+	}
 	return iter.Error()
 }
 
-func (c Cache) Merge() error {
-	cc, err := leveldb.OpenFile(string(c), nil)
-	if err != nil {
-		return err
-	}
-	defer cc.Close()
-	return cc.CompactRange(util.Range{nil, nil})
+// Merge compacts the files of the underlying database.
+func (c *Cache) Merge() error {
+	return c.db.CompactRange(util.Range{})
+}
+
+// Close flushes and closes the underlying database.
+func (c *Cache) Close() error {
+	return c.db.Close()
 }
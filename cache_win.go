@@ -22,7 +22,9 @@
 package main
 
 import (
+	"bytes"
 	"errors"
+
 	"github.com/akrylysov/pogreb"
 )
 
@@ -30,49 +32,70 @@ import (
 var ErrIterationDone = pogreb.ErrIterationDone
 
 // Cache is the abstraction object to the key-value database used for caching.
-type Cache string
+// The underlying database is kept open until Close is called and it's safe
+// for concurrent use.
+type Cache struct {
+	db   *pogreb.DB
+	keys *keyIndex
+}
 
-// Put stores a value in the cache.
-func (c Cache) Put(key, val []byte) error {
-	cc, err := pogreb.Open(string(c), nil)
+// OpenCache opens the cache at the given path creating it if it doesn't exist.
+func OpenCache(path string) (*Cache, error) {
+	db, err := pogreb.Open(path, nil)
 	if err != nil {
+		return nil, err
+	}
+
+	// Pogreb can only list the keys along with the values, so opening the
+	// cache reads it whole once.
+	c := &Cache{db: db}
+	var keys [][]byte
+	err = c.Fold(func(key, _ []byte) error {
+		keys = append(keys, append([]byte{}, key...))
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	c.keys = newKeyIndex(keys)
+	return c, nil
+}
+
+// Put stores a value in the cache.
+func (c *Cache) Put(key, val []byte) error {
+	c.keys.Lock()
+	defer c.keys.Unlock()
+
+	if err := c.db.Put(key, val); err != nil {
 		return err
 	}
-	defer cc.Close()
-	return cc.Put(key, val)
+	c.keys.insert(key)
+	return nil
 }
 
 // Get returns the value from the cache associated with the given key.
 // If no value is associated with the given key nil is returned.
-func (c Cache) Get(key []byte) ([]byte, error) {
-	cc, err := pogreb.Open(string(c), nil)
-	if err != nil {
-		return []byte{}, err
-	}
-	defer cc.Close()
-	return cc.Get(key)
+func (c *Cache) Get(key []byte) ([]byte, error) {
+	return c.db.Get(key)
 }
 
 // Del deletes the value in the cache that corresponds to the given key.
-func (c Cache) Del(key []byte) error {
-	cc, err := pogreb.Open(string(c), nil)
-	if err != nil {
+func (c *Cache) Del(key []byte) error {
+	c.keys.Lock()
+	defer c.keys.Unlock()
+
+	if err := c.db.Delete(key); err != nil {
 		return err
 	}
-	defer cc.Close()
-	return cc.Delete(key)
+	c.keys.remove(key)
+	return nil
 }
 
 // Fold iterates over all the key-value pairs stored in the cache and calls the
 // function in input passing those values as argument.
-func (c Cache) Fold(fn func(key, val []byte) error) (err error) {
-	cc, err := pogreb.Open(string(c), nil)
-	if err != nil {
-		return err
-	}
-	defer cc.Close()
-
-	iter := cc.Items()
+func (c *Cache) Fold(fn func(key, val []byte) error) (err error) {
+	iter := c.db.Items()
 
 	for err == nil {
 		var k, v []byte
@@ -88,13 +111,26 @@ func (c Cache) Fold(fn func(key, val []byte) error) (err error) {
 	return
 }
 
-func (c Cache) Merge() error {
-	cc, err := pogreb.Open(string(c), nil)
-	if err != nil {
-		return err
-	}
-	defer cc.Close()
+// Scan iterates over all the key-value pairs whose key starts with the given
+// prefix and calls the function in input passing those values as argument.
+// Pogreb doesn't keep the keys sorted so this seeks the prefix in the index
+// of the keys.
+func (c *Cache) Scan(prefix []byte, fn func(key, val []byte) error) error {
+	return c.Seek(prefix, func(key, val []byte) error {
+		if !bytes.HasPrefix(key, prefix) {
+			return ErrIterationDone
+		}
+		return fn(key, val)
+	})
+}
 
-	_, err = cc.Compact()
+// Merge compacts the files of the underlying database.
+func (c *Cache) Merge() error {
+	_, err := c.db.Compact()
 	return err
 }
+
+// Close flushes and closes the underlying database.
+func (c *Cache) Close() error {
+	return c.db.Close()
+}
@@ -0,0 +1,220 @@
+/*
+ * Adam - Adam's a Data Access Manager
+ * Copyright (C) 2021 Nicolò Santamaria
+ *
+ * Adam is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Adam is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Every change to the files is appended to the change log in the same
+// transaction that applies it, numbered with a sequence number that is one
+// more than the one of the previous change. The clients keep the sequence
+// number of the last change they've seen and ask for the ones after it.
+
+// ccChanges maps the sequence number of each change to the Change, and
+// lastSeqKey to the sequence number of the last one.
+var ccChanges *Cache
+
+var lastSeqKey = []byte("last")
+
+// The kinds of change.
+const (
+	changePut       = "put"
+	changeOverwrite = "overwrite"
+	changeMove      = "move"
+	changeDelete    = "delete"
+	changeMeta      = "meta"
+	changeRestore   = "restore"
+)
+
+// Change represents a change to a file, From is the previous path of a moved
+// file.
+type Change struct {
+	Seq       uint64    `json:"seq"`
+	Op        string    `json:"op"`
+	Time      time.Time `json:"time"`
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`
+	From      string    `json:"from,omitempty"`
+	Sha256sum string    `json:"sha256sum,omitempty"`
+}
+
+// ChangesResponse represents the json returned after a /changes call, cursor
+// is the sequence number to ask for the following changes and more tells
+// whether there are any.
+type ChangesResponse struct {
+	Base
+	Changes []Change `json:"changes"`
+	Cursor  uint64   `json:"cursor"`
+	More    bool     `json:"more"`
+}
+
+func changeKey(seq uint64) []byte {
+	return []byte(fmt.Sprintf("%020d", seq))
+}
+
+// parseSeq parses a sequence number, the missing one is 0.
+func parseSeq(b []byte) (uint64, error) {
+	if b == nil {
+		return 0, nil
+	}
+	return strconv.ParseUint(string(b), 10, 64)
+}
+
+// lastSeq returns the sequence number of the last change.
+func lastSeq() (uint64, error) {
+	b, err := ccChanges.Get(lastSeqKey)
+	if err != nil {
+		return 0, err
+	}
+	return parseSeq(b)
+}
+
+// logChange stages in tx the append of c to the change log.
+func logChange(tx *Txn, c Change) error {
+	b, err := tx.Get(ccChanges, lastSeqKey)
+	if err != nil {
+		return err
+	}
+	last, err := parseSeq(b)
+	if err != nil {
+		return err
+	}
+
+	c.Seq = last + 1
+	c.Time = time.Now().UTC()
+	if b, err = json.Marshal(c); err != nil {
+		return err
+	}
+	tx.Put(ccChanges, changeKey(c.Seq), b)
+	tx.Put(ccChanges, lastSeqKey, []byte(strconv.FormatUint(c.Seq, 10)))
+	return nil
+}
+
+// logSave stages in tx the changes of storing file at a path that was
+// associated with oldID, a file replaced by one with another ID is deleted.
+func logSave(tx *Txn, oldID string, file File) error {
+	var op = changePut
+
+	switch oldID {
+	case "":
+	case file.ID:
+		op = changeOverwrite
+	default:
+		if err := logChange(tx, Change{Op: changeDelete, ID: oldID, Path: file.Path}); err != nil {
+			return err
+		}
+	}
+	return logChange(tx, Change{Op: op, ID: file.ID, Path: file.Path, Sha256sum: file.Sha256sum})
+}
+
+// changes looks at most at limit changes after the one with sequence number
+// cursor and returns the ones for which keep returns true, along with the
+// sequence number of the last change looked at and the one of the last change
+// in the log.
+func changes(cursor uint64, limit int, keep func(Change) bool) ([]Change, uint64, uint64, error) {
+	var res = []Change{}
+
+	last, err := lastSeq()
+	if err != nil {
+		return nil, cursor, 0, err
+	}
+
+	for n := 0; cursor < last && n < limit; n++ {
+		b, err := ccChanges.Get(changeKey(cursor + 1))
+		if err != nil {
+			return nil, cursor, last, err
+		}
+		cursor++
+
+		if b == nil {
+			continue
+		}
+		var c Change
+		if err := json.Unmarshal(b, &c); err != nil {
+			return nil, cursor, last, err
+		}
+		if keep(c) {
+			res = append(res, c)
+		}
+	}
+	return res, cursor, last, nil
+}
+
+func handleChanges(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	if !allow(w, r, permRead) {
+		return
+	}
+
+	// The changes of the files the client isn't allowed to read are left
+	// out, a move is shown if either of the paths is readable.
+	p, err := authenticate(r)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		fail(w, errorf(http.StatusBadRequest, "%v", err))
+		return
+	}
+
+	var (
+		cursor uint64
+		limit  = defaultQueryLimit
+	)
+	if c := values.Get("cursor"); c != "" {
+		if cursor, err = strconv.ParseUint(c, 10, 64); err != nil {
+			fail(w, errorf(http.StatusBadRequest, "invalid cursor %q", c))
+			return
+		}
+	}
+	if l := values.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > maxQueryLimit {
+			fail(w, errorf(http.StatusBadRequest, "invalid limit %q", l))
+			return
+		}
+	}
+
+	res, cursor, last, err := changes(cursor, limit, func(c Change) bool {
+		return p.can(permRead, c.Path) || (c.From != "" && p.can(permRead, c.From))
+	})
+	if err != nil {
+		log.Println("handleChanges", "changes", err)
+		fail(w, err)
+		return
+	}
+
+	reply(w, http.StatusOK, ChangesResponse{
+		Base:    Base{OK: true},
+		Changes: res,
+		Cursor:  cursor,
+		More:    cursor < last,
+	})
+}
@@ -29,19 +29,38 @@ import (
 
 // Config contains all the configuration data.
 type Config struct {
-	Port       string `toml:"port"`
-	BaseDir    string `toml:"base_dir"`
-	CacheDir   string `toml:"cache_dir"`
-	CertPath   string `toml:"cert_path"`
-	ServerKey  string `toml:"server_key"`
-	EnableTLS  bool   `toml:"enable_tls"`
-	backupFile string
+	Port              string      `toml:"port"`
+	BaseDir           string      `toml:"base_dir"`
+	CacheDir          string      `toml:"cache_dir"`
+	CertPath          string      `toml:"cert_path"`
+	ServerKey         string      `toml:"server_key"`
+	EnableTLS         bool        `toml:"enable_tls"`
+	AutoCert          bool        `toml:"auto_cert"`
+	TLSHosts          []string    `toml:"tls_hosts"`
+	ScrubRate         int         `toml:"scrub_rate"`
+	ScrubPeriod       int         `toml:"scrub_period"`
+	UploadExpiry      int         `toml:"upload_expiry"`
+	MaxUploadSize     int64       `toml:"max_upload_size"`
+	SymlinkPolicy     string      `toml:"symlink_policy"`
+	Dedup             bool        `toml:"dedup"`
+	MaxVersions       int         `toml:"max_versions"`
+	TrashExpiry       int         `toml:"trash_expiry"`
+	APIKeys           []KeyConfig `toml:"api_keys"`
+	ACL               []ACLRule   `toml:"acl"`
+	URLSecret         string      `toml:"url_secret"`
+	AccessLog         bool        `toml:"access_log"`
+	ClientCA          string      `toml:"client_ca"`
+	ClientAuth        string      `toml:"client_auth"`
+	ClientPrincipal   string      `toml:"client_principal"`
+	ClientPermissions []string    `toml:"client_permissions"`
+	backupFile        string
 }
 
 func parseConfig(path string) Config {
 	var c Config
 
-	if _, err := toml.DecodeFile(path, &c); err != nil {
+	md, err := toml.DecodeFile(path, &c)
+	if err != nil {
 		log.Println("parseConfig", err)
 	}
 
@@ -59,5 +78,44 @@ func parseConfig(path string) Config {
 		c.BaseDir = filepath.Join(Home, ".adam")
 	}
 
+	if c.ScrubPeriod == 0 {
+		c.ScrubPeriod = 24
+	}
+
+	if c.UploadExpiry == 0 {
+		c.UploadExpiry = 24
+	}
+
+	// Zero disables the versioning, so only a missing key gets the default.
+	if !md.IsDefined("max_versions") {
+		c.MaxVersions = 10
+	}
+
+	// Zero keeps the deleted files until they're purged.
+	if !md.IsDefined("trash_expiry") {
+		c.TrashExpiry = 30
+	}
+
+	if c.ClientAuth == "" {
+		c.ClientAuth = clientAuthRequire
+	}
+
+	if c.ClientPrincipal == "" {
+		c.ClientPrincipal = subjectNone
+	}
+
+	if c.ClientPermissions == nil {
+		c.ClientPermissions = []string{"read", "write", "delete", "move"}
+	}
+
+	switch c.SymlinkPolicy {
+	case symlinksInside, symlinksDeny, symlinksFollow:
+	case "":
+		c.SymlinkPolicy = symlinksInside
+	default:
+		log.Printf("parseConfig: invalid symlink_policy %q, using %q", c.SymlinkPolicy, symlinksDeny)
+		c.SymlinkPolicy = symlinksDeny
+	}
+
 	return c
 }
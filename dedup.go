@@ -0,0 +1,132 @@
+/*
+ * Adam - Adam's a Data Access Manager
+ * Copyright (C) 2021 Nicolò Santamaria
+ *
+ * Adam is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Adam is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// In deduplicating mode the content of the files is stored once in the blob
+// store under its sha256sum and the files in the base directory are hard
+// links to the blobs. Since Adam never modifies a file in place but always
+// replaces it, the files sharing the same blob can't affect each other.
+// The number of files linked to each blob is kept in ccBlobs and the blob is
+// removed along with the last of them.
+
+// ccBlobs maps the sha256sum of each blob to the number of files linked to it.
+var ccBlobs *Cache
+
+func blobsDir() string {
+	return filepath.Join(cfg.BaseDir, internalDir, "blobs")
+}
+
+// blobPath returns the path of the blob with the given sha256sum.
+func blobPath(hash string) string {
+	return filepath.Join(blobsDir(), hash[:2], hash)
+}
+
+// refs returns the number of files linked to the blob with the given hash.
+func refs(tx *Txn, hash string) (int, error) {
+	b, err := tx.Get(ccBlobs, []byte(hash))
+	if err != nil || b == nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(b))
+}
+
+// sameFile reports whether both paths exist and refer to the same file.
+func sameFile(a, b string) bool {
+	ia, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	ib, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(ia, ib)
+}
+
+// linkBlob stages the linking of path to the blob with the content of the
+// upload, which is moved to the blob store if no such blob exists yet.
+func linkBlob(tx *Txn, u upload, path string) error {
+	var blob = blobPath(u.hash)
+
+	n, err := refs(tx, u.hash)
+	if err != nil {
+		return err
+	}
+
+	ok, err := exists(blob)
+	if err != nil {
+		return err
+	}
+	if n == 0 || !ok {
+		tx.Rename(u.tmp, blob)
+	}
+
+	tx.Link(blob, path)
+	tx.Put(ccBlobs, []byte(u.hash), []byte(strconv.Itoa(n+1)))
+	return nil
+}
+
+// retainBlob stages the acquisition of a reference to the blob with the given
+// hash by the file at path, if it's linked to it.
+func retainBlob(tx *Txn, path, hash string) error {
+	if len(hash) < 2 || !sameFile(path, blobPath(hash)) {
+		return nil
+	}
+
+	n, err := refs(tx, hash)
+	if err != nil {
+		return err
+	}
+	tx.Put(ccBlobs, []byte(hash), []byte(strconv.Itoa(n+1)))
+	return nil
+}
+
+// unlinkBlob stages the release of the blob the file at path is linked to
+// and returns the path of the blob if it's no longer referenced, in which case
+// the caller must stage its removal along with the other ones.
+// The files that aren't linked to a blob, like the ones stored before the
+// deduplication was enabled, are ignored.
+func unlinkBlob(tx *Txn, path, hash string) (string, error) {
+	if len(hash) < 2 {
+		return "", nil
+	}
+
+	var blob = blobPath(hash)
+	if !sameFile(path, blob) {
+		return "", nil
+	}
+
+	n, err := refs(tx, hash)
+	if err != nil {
+		return "", err
+	}
+
+	if n <= 1 {
+		tx.Del(ccBlobs, []byte(hash))
+		return blob, nil
+	}
+	tx.Put(ccBlobs, []byte(hash), []byte(strconv.Itoa(n-1)))
+	return "", nil
+}
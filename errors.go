@@ -0,0 +1,165 @@
+/*
+ * Adam - Adam's a Data Access Manager
+ * Copyright (C) 2021 Nicolò Santamaria
+ *
+ * Adam is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Adam is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Machine readable codes of the errors, each one matches an HTTP status.
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusPreconditionFailed:    "precondition_failed",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusInternalServerError:   "internal_error",
+}
+
+// Error is an error carrying the HTTP status Adam replies with.
+type Error struct {
+	Status int
+	Msg    string
+}
+
+func (e Error) Error() string {
+	return e.Msg
+}
+
+// Code returns the machine readable code of the error.
+func (e Error) Code() string {
+	if c, ok := errorCodes[e.Status]; ok {
+		return c
+	}
+	return errorCodes[http.StatusInternalServerError]
+}
+
+// errorf returns an Error with the given HTTP status and formatted message.
+func errorf(status int, format string, a ...interface{}) error {
+	return Error{status, fmt.Sprintf(format, a...)}
+}
+
+// asError converts any error to an Error, the errors not generated with
+// errorf are considered internal errors except the missing files.
+func asError(err error) Error {
+	var e Error
+
+	switch {
+	case errors.As(err, &e):
+		return e
+	case errors.Is(err, os.ErrNotExist):
+		return Error{http.StatusNotFound, "file not found"}
+	default:
+		return Error{http.StatusInternalServerError, err.Error()}
+	}
+}
+
+// FileError represents the json describing an error about a single file.
+type FileError struct {
+	Path    string `json:"path,omitempty"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	status  int
+}
+
+func (f FileError) Error() string {
+	if f.Path == "" {
+		return f.Message
+	}
+	return fmt.Sprintf("%s: %s", f.Path, f.Message)
+}
+
+// fileError returns the FileError describing err for the file at path.
+func fileError(path string, err error) FileError {
+	e := asError(err)
+	return FileError{
+		Path:    path,
+		Code:    e.Code(),
+		Message: e.Msg,
+		status:  e.Status,
+	}
+}
+
+// fail replies to the request with the HTTP status matching err and the Base
+// object with ok=false and the error encoded in json.
+func fail(w http.ResponseWriter, err error) {
+	e := asError(err)
+	b, err := json.Marshal(Base{OK: false, Error: e.Msg, Code: e.Code()})
+	if err != nil {
+		log.Println("fail", "json.Marshal", err)
+		http.Error(w, "internal server error, check logs for details", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	fmt.Fprintln(w, string(b))
+}
+
+// checkMethod replies with 405 and returns false if the method of the request
+// isn't among the allowed ones.
+func checkMethod(w http.ResponseWriter, r *http.Request, allowed ...string) bool {
+	for _, m := range allowed {
+		if r.Method == m {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	fail(w, errorf(
+		http.StatusMethodNotAllowed,
+		"invalid request, expected %s got %s",
+		strings.Join(allowed, " or "),
+		r.Method,
+	))
+	return false
+}
+
+// reply writes the response encoded in json with the given HTTP status.
+func reply(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Println("reply", "json.Marshal", err)
+		fail(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintln(w, string(b))
+}
+
+// putStatus returns the HTTP status of a response about multiple files, that
+// is the status of the first error if none of the files succeeded.
+func putStatus(files []File, errs []FileError) int {
+	if len(files) == 0 && len(errs) > 0 {
+		return errs[0].status
+	}
+	return http.StatusOK
+}
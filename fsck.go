@@ -0,0 +1,258 @@
+/*
+ * Adam - Adam's a Data Access Manager
+ * Copyright (C) 2021 Nicolò Santamaria
+ *
+ * Adam is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Adam is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+)
+
+// Mismatch represents a file whose content doesn't match the stored checksum.
+type Mismatch struct {
+	Path     string
+	Expected string
+	Actual   string
+}
+
+// FsckReport contains all the inconsistencies found between the base
+// directory and the caches.
+type FsckReport struct {
+	// Files on disk without an ID.
+	Untracked []string
+	// IDs pointing to missing files.
+	Missing []File
+	// Files whose content doesn't match the stored checksum.
+	Mismatches []Mismatch
+	// Checksums of paths without an ID.
+	Orphans []string
+	// Entries of the path index that don't match the IDs.
+	Stale []string
+}
+
+// Len returns the total number of inconsistencies in the report.
+func (r FsckReport) Len() int {
+	return len(r.Untracked) + len(r.Missing) + len(r.Mismatches) + len(r.Orphans) + len(r.Stale)
+}
+
+// fsck walks the base directory and the caches looking for inconsistencies.
+func fsck() (r FsckReport, err error) {
+	err = filepath.WalkDir(cfg.BaseDir, func(abs string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(cfg.BaseDir, abs)
+		if err != nil {
+			return err
+		}
+		if rel == internalDir {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		id, err := findIDFromPath(rel)
+		if err != nil {
+			return err
+		}
+		// A path index entry not matching the IDs is reported as stale
+		// below and the file is untracked anyway.
+		if p, err := ccID.Get([]byte(id)); err != nil {
+			return err
+		} else if id == "" || string(p) != rel {
+			r.Untracked = append(r.Untracked, rel)
+			return nil
+		}
+
+		hash, err := hashFile(abs)
+		if err != nil {
+			return err
+		}
+		if stored, err := ccHash.Get([]byte(rel)); err != nil {
+			return err
+		} else if string(stored) != hash {
+			r.Mismatches = append(r.Mismatches, Mismatch{rel, string(stored), hash})
+		}
+		return nil
+	})
+	if err != nil {
+		return r, fmt.Errorf("fsck filepath.WalkDir: %w", err)
+	}
+
+	err = ccID.Fold(func(id, path []byte) error {
+		ok, err := exists(filepath.Join(cfg.BaseDir, string(path)))
+		if err != nil {
+			return err
+		} else if !ok {
+			r.Missing = append(r.Missing, File{ID: string(id), Path: string(path)})
+		}
+		return nil
+	})
+	if err != nil {
+		return r, fmt.Errorf("fsck ccID.Fold: %w", err)
+	}
+
+	err = ccPath.Fold(func(path, id []byte) error {
+		if p, err := ccID.Get(id); err != nil {
+			return err
+		} else if string(p) != string(path) {
+			r.Stale = append(r.Stale, string(path))
+		}
+		return nil
+	})
+	if err != nil {
+		return r, fmt.Errorf("fsck ccPath.Fold: %w", err)
+	}
+
+	err = ccHash.Fold(func(path, _ []byte) error {
+		if id, err := ccPath.Get(path); err != nil {
+			return err
+		} else if id == nil {
+			r.Orphans = append(r.Orphans, string(path))
+		}
+		return nil
+	})
+	if err != nil {
+		return r, fmt.Errorf("fsck ccHash.Fold: %w", err)
+	}
+
+	return r, nil
+}
+
+// repair fixes the inconsistencies in the report by assigning new IDs to the
+// untracked files, recomputing the wrong checksums and pruning the dangling
+// entries of the caches.
+func repair(r FsckReport) error {
+	return update(func(tx *Txn) error {
+		for _, path := range r.Stale {
+			tx.Del(ccPath, []byte(path))
+		}
+
+		for _, f := range r.Missing {
+			if err := unindexPath(tx, f.Path, f.ID); err != nil {
+				return err
+			}
+			if err := logChange(tx, Change{Op: changeDelete, ID: f.ID, Path: f.Path}); err != nil {
+				return err
+			}
+		}
+
+		for _, path := range r.Orphans {
+			tx.Del(ccHash, []byte(path))
+		}
+
+		for _, m := range r.Mismatches {
+			id, err := tx.Get(ccPath, []byte(m.Path))
+			if err != nil {
+				return err
+			}
+			if id != nil {
+				if err := unindexQuery(tx, string(id), m.Path); err != nil {
+					return err
+				}
+			}
+			tx.Put(ccHash, []byte(m.Path), []byte(m.Actual))
+			if id != nil {
+				if err := indexQuery(tx, string(id), m.Path); err != nil {
+					return err
+				}
+				err := logChange(tx, Change{Op: changeOverwrite, ID: string(id), Path: m.Path, Sha256sum: m.Actual})
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, path := range r.Untracked {
+			hash, err := hashFile(filepath.Join(cfg.BaseDir, path))
+			if err != nil {
+				return err
+			}
+
+			id, err := uuid.NewRandom()
+			if err != nil {
+				return err
+			}
+
+			err = indexFile(tx, File{ID: id.String(), Path: path, Sha256sum: hash})
+			if err != nil {
+				return err
+			}
+			err = logChange(tx, Change{Op: changePut, ID: id.String(), Path: path, Sha256sum: hash})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// runFsck executes the fsck command with the given arguments and returns the
+// exit status.
+func runFsck(args []string) int {
+	fset := flag.NewFlagSet("fsck", flag.ExitOnError)
+	fix := fset.Bool("repair", false, "Assign new IDs to untracked files, recompute wrong checksums and prune dangling entries.")
+	fset.Parse(args)
+
+	r, err := fsck()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	for _, p := range r.Untracked {
+		fmt.Println("untracked:", p)
+	}
+	for _, f := range r.Missing {
+		fmt.Printf("missing: %s (id %s)\n", f.Path, f.ID)
+	}
+	for _, m := range r.Mismatches {
+		fmt.Printf("mismatch: %s (stored %q, actual %s)\n", m.Path, m.Expected, m.Actual)
+	}
+	for _, p := range r.Orphans {
+		fmt.Println("orphan checksum:", p)
+	}
+	for _, p := range r.Stale {
+		fmt.Println("stale path index entry:", p)
+	}
+
+	switch {
+	case r.Len() == 0:
+		fmt.Println("ok")
+		return 0
+
+	case *fix:
+		if err := repair(r); err != nil {
+			fmt.Fprintln(os.Stderr, "repair:", err)
+			return 2
+		}
+		fmt.Printf("repaired %d problems\n", r.Len())
+		return 0
+
+	default:
+		fmt.Printf("found %d problems, run with -repair to fix them\n", r.Len())
+		return 1
+	}
+}
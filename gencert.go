@@ -0,0 +1,220 @@
+/*
+ * Adam - Adam's a Data Access Manager
+ * Copyright (C) 2021 Nicolò Santamaria
+ *
+ * Adam is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Adam is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// certValidity is the default validity of the generated certificates.
+const certValidity = 365 * 24 * time.Hour
+
+// defaultHosts returns the host names and IPs of the generated certificates
+// when none is configured.
+func defaultHosts() []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if h, err := os.Hostname(); err == nil && h != "localhost" {
+		hosts = append(hosts, h)
+	}
+	return hosts
+}
+
+// certPaths returns the paths of the certificate and of the key, defaulting
+// to the cache directory.
+func certPaths() (cert, key string) {
+	cert, key = cfg.CertPath, cfg.ServerKey
+	if cert == "" {
+		cert = filepath.Join(cfg.CacheDir, "cert.pem")
+	}
+	if key == "" {
+		key = filepath.Join(cfg.CacheDir, "key.pem")
+	}
+	return
+}
+
+// genCert generates an ECDSA key and a self-signed certificate valid for the
+// given host names and IPs and saves them in PEM format.
+func genCert(certPath, keyPath string, hosts []string, validity time.Duration) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("genCert ecdsa.GenerateKey: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("genCert rand.Int: %w", err)
+	}
+
+	tmpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Adam"}, CommonName: hosts[0]},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("genCert x509.CreateCertificate: %w", err)
+	}
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("genCert x509.MarshalPKCS8PrivateKey: %w", err)
+	}
+
+	// The key is written first so that a certificate never exists without it.
+	if err := writePEM(keyPath, "PRIVATE KEY", pkcs8, 0600); err != nil {
+		return err
+	}
+	return writePEM(certPath, "CERTIFICATE", der, 0644)
+}
+
+// writePEM atomically writes the PEM encoded block to path.
+func writePEM(path, typ string, b []byte, perm os.FileMode) error {
+	if err := mkdirAllSync(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("writePEM: %w", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".adam-pem-*")
+	if err != nil {
+		return fmt.Errorf("writePEM: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := f.Chmod(perm); err != nil {
+		return fmt.Errorf("writePEM: %w", err)
+	}
+	if err := pem.Encode(f, &pem.Block{Type: typ, Bytes: b}); err != nil {
+		return fmt.Errorf("writePEM: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("writePEM: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("writePEM: %w", err)
+	}
+	return renameSync(f.Name(), path)
+}
+
+// ensureCert sets the paths of the certificate and of the key used for TLS,
+// defaulting to the ones generated by gencert, and generates them if they
+// don't exist yet and the automatic generation is enabled.
+func ensureCert() error {
+	cfg.CertPath, cfg.ServerKey = certPaths()
+
+	if !cfg.AutoCert {
+		return nil
+	}
+
+	certOK, err := exists(cfg.CertPath)
+	if err != nil {
+		return fmt.Errorf("ensureCert: %w", err)
+	}
+	keyOK, err := exists(cfg.ServerKey)
+	if err != nil {
+		return fmt.Errorf("ensureCert: %w", err)
+	}
+
+	switch {
+	case certOK && keyOK:
+		return nil
+	case certOK != keyOK:
+		return fmt.Errorf("ensureCert: only one of %s and %s exists", cfg.CertPath, cfg.ServerKey)
+	}
+
+	hosts := cfg.TLSHosts
+	if len(hosts) == 0 {
+		hosts = defaultHosts()
+	}
+
+	log.Printf("generating a self-signed certificate for %s in %s", strings.Join(hosts, ", "), cfg.CertPath)
+	return genCert(cfg.CertPath, cfg.ServerKey, hosts, certValidity)
+}
+
+func runGencert(args []string) int {
+	var (
+		fset  = flag.NewFlagSet("gencert", flag.ExitOnError)
+		hosts = fset.String("host", strings.Join(cfg.TLSHosts, ","), "Comma-separated host names and IPs the certificate is valid for.")
+		days  = fset.Int("days", int(certValidity/(24*time.Hour)), "The number of days the certificate is valid for.")
+		force = fset.Bool("force", false, "Overwrite the existing certificate and key.")
+	)
+	fset.Parse(args)
+
+	var list []string
+	for _, h := range strings.Split(*hosts, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			list = append(list, h)
+		}
+	}
+	if len(list) == 0 {
+		list = defaultHosts()
+	}
+
+	if *days <= 0 {
+		fmt.Fprintln(os.Stderr, "gencert: days must be positive")
+		return 2
+	}
+
+	cert, key := certPaths()
+	for _, p := range []string{cert, key} {
+		ok, err := exists(p)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "gencert:", err)
+			return 2
+		} else if ok && !*force {
+			fmt.Fprintf(os.Stderr, "gencert: %s already exists, use -force to overwrite it\n", p)
+			return 1
+		}
+	}
+
+	if err := genCert(cert, key, list, time.Duration(*days)*24*time.Hour); err != nil {
+		fmt.Fprintln(os.Stderr, "gencert:", err)
+		return 2
+	}
+
+	fmt.Println("certificate:", cert)
+	fmt.Println("key:", key)
+	fmt.Println("hosts:", strings.Join(list, ", "))
+	return 0
+}
@@ -18,17 +18,56 @@
 
 package main
 
+import "time"
+
 // Base is the base json returned after each request.
 type Base struct {
 	OK    bool   `json:"ok"`
 	Error string `json:"error,omitempty"`
+	Code  string `json:"code,omitempty"`
 }
 
 // PutResponse represents the json returned after a /put call.
 type PutResponse struct {
 	Base
-	Files  []File  `json:"files,omitempty"`
-	Errors []error `json:"errors,omitempty"`
+	Files  []File      `json:"files,omitempty"`
+	Errors []FileError `json:"errors,omitempty"`
+}
+
+// MetaResponse represents the json returned after a paginated /get_meta call,
+// cursor is set if there are more files.
+type MetaResponse struct {
+	Base
+	Files  []File      `json:"files"`
+	Errors []FileError `json:"errors,omitempty"`
+	Cursor string      `json:"cursor,omitempty"`
+}
+
+// FileResponse represents the json returned by the /v1 API.
+type FileResponse struct {
+	Base
+	File *File `json:"file,omitempty"`
+}
+
+// KeysResponse represents the json returned after a GET /keys call.
+type KeysResponse struct {
+	Base
+	Keys []APIKey `json:"keys"`
+}
+
+// KeyResponse represents the json returned after the creation of an API key,
+// the key in clear is returned only once.
+type KeyResponse struct {
+	Base
+	Key    APIKey `json:"key"`
+	Secret string `json:"secret"`
+}
+
+// PresignResponse represents the json returned after a /presign call.
+type PresignResponse struct {
+	Base
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
 }
 
 // ChecksumResponse represents the json returned after a /sha256sum call.
@@ -43,6 +82,33 @@ type File struct {
 	Path      string `json:"path"`
 	Sha256sum string `json:"sha256sum,omitempty"`
 	ID        string `json:"id,omitempty"`
+	*Stat
+	*Meta
+}
+
+// Stat represents the json containing the metadata recorded when a file is
+// stored, it's missing for the files stored by older versions of Adam.
+type Stat struct {
+	Size     int64     `json:"size"`
+	MIME     string    `json:"mime"`
+	Created  time.Time `json:"created"`
+	Modified time.Time `json:"modified"`
+	Uploader string    `json:"uploader,omitempty"`
+}
+
+// Meta represents the json containing the user-defined metadata of a file,
+// free form attributes and tags.
+type Meta struct {
+	Attrs map[string]string `json:"attrs,omitempty"`
+	Tags  []string          `json:"tags,omitempty"`
+}
+
+// MetaPatch represents the json body of a PATCH /meta request, the attributes
+// with a null value are removed.
+type MetaPatch struct {
+	Attrs      map[string]*string `json:"attrs"`
+	AddTags    []string           `json:"add_tags"`
+	RemoveTags []string           `json:"remove_tags"`
 }
 
 // InputFile represents the json containing a file content encoded in base64
@@ -51,4 +117,26 @@ type InputFile struct {
 	ID      string `json:"id"`
 	Path    string `json:"path"`
 	Content string `json:"content"`
+	*Meta
+}
+
+// MoveRequest represents the json body of a /v1 PATCH request.
+type MoveRequest struct {
+	Path string `json:"path"`
+}
+
+// KeyRequest represents the json body of a POST /keys request.
+type KeyRequest struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+// PresignRequest represents the json body of a /presign request.
+type PresignRequest struct {
+	Op          string `json:"op"`
+	ID          string `json:"id,omitempty"`
+	Path        string `json:"path,omitempty"`
+	ExpiresIn   int64  `json:"expires_in,omitempty"`
+	MaxSize     int64  `json:"max_size,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
 }
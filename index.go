@@ -0,0 +1,168 @@
+/*
+ * Adam - Adam's a Data Access Manager
+ * Copyright (C) 2021 Nicolò Santamaria
+ *
+ * Adam is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Adam is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// ccPath is the reverse index of ccID, it maps each path to the ID of the file.
+var ccPath *Cache
+
+// inTree reports whether path is root itself or is contained in it.
+func inTree(path, root string) bool {
+	if root == "." {
+		return true
+	}
+	return path == root || strings.HasPrefix(path, root+string(filepath.Separator))
+}
+
+// findIDFromPath returns the ID of the file at the given path or an empty
+// string if the path is unknown.
+func findIDFromPath(path string) (string, error) {
+	id, err := ccPath.Get([]byte(filepath.Clean(path)))
+	return string(id), err
+}
+
+// subtree returns a map of all the paths contained in root (root included)
+// to their respective ID.
+func subtree(root string) (map[string]string, error) {
+	var (
+		files  = make(map[string]string)
+		prefix []byte
+	)
+
+	if root = filepath.Clean(root); root != "." {
+		prefix = []byte(root)
+	}
+
+	err := ccPath.Scan(prefix, func(path, id []byte) error {
+		// The prefix scan matches also siblings like "dirname" for "dir".
+		if p := string(path); inTree(p, root) {
+			files[p] = string(id)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// rebuildPathIndex populates ccPath from the content of ccID.
+func rebuildPathIndex() error {
+	return ccID.Fold(func(id, path []byte) error {
+		if err := ccPath.Put(path, id); err != nil {
+			return fmt.Errorf("rebuildPathIndex ccPath.Put: %w", err)
+		}
+		return nil
+	})
+}
+
+// describe returns the file with the given ID and path along with its
+// checksum, Stat and Meta.
+func describe(id, path string) (File, error) {
+	var file = File{ID: id, Path: path}
+
+	h, err := ccHash.Get([]byte(path))
+	if err != nil {
+		return file, err
+	}
+	file.Sha256sum = string(h)
+
+	if file.Stat, err = fileStat(id); err != nil {
+		return file, err
+	}
+	file.Meta, err = fileMeta(id)
+	return file, err
+}
+
+// indexFile stages in tx the association of the file's ID, path, checksum,
+// Stat and Meta dropping the stale entries in case the path was previously
+// associated with another ID. An ID already associated with another path is
+// rejected with 409 Conflict.
+func indexFile(tx *Txn, f File) error {
+	var (
+		id   = []byte(f.ID)
+		path = []byte(f.Path)
+	)
+
+	old, err := tx.Get(ccPath, path)
+	if err != nil {
+		return err
+	} else if old != nil {
+		if err := unindexQuery(tx, string(old), f.Path); err != nil {
+			return err
+		}
+		if string(old) != f.ID {
+			tx.Del(ccID, old)
+			tx.Del(ccStat, old)
+			tx.Del(ccMeta, old)
+		}
+	}
+
+	// Taking over the ID of a file at another path would leave that file
+	// with neither ID nor checksum, it must be moved instead.
+	if oldpath, err := tx.Get(ccID, id); err != nil {
+		return err
+	} else if oldpath != nil && string(oldpath) != f.Path {
+		return errorf(http.StatusConflict, "id %s is used by %s", f.ID, oldpath)
+	}
+
+	tx.Put(ccID, id, path)
+	tx.Put(ccPath, path, id)
+	tx.Put(ccHash, path, []byte(f.Sha256sum))
+
+	// The files restored from a backup may come without a Stat.
+	if f.Stat != nil {
+		b, err := json.Marshal(f.Stat)
+		if err != nil {
+			return err
+		}
+		tx.Put(ccStat, id, b)
+	}
+	// Likewise the Meta, which is removed only if explicitly empty.
+	if f.Meta != nil {
+		if f.Meta.empty() {
+			tx.Del(ccMeta, id)
+		} else {
+			b, err := json.Marshal(f.Meta)
+			if err != nil {
+				return err
+			}
+			tx.Put(ccMeta, id, b)
+		}
+	}
+	return indexQuery(tx, f.ID, f.Path)
+}
+
+// unindexPath stages in tx the removal of the ID, path, checksum, Stat and
+// Meta of the file at the given path.
+func unindexPath(tx *Txn, path, id string) error {
+	if err := unindexQuery(tx, id, path); err != nil {
+		return err
+	}
+	tx.Del(ccHash, []byte(path))
+	tx.Del(ccStat, []byte(id))
+	tx.Del(ccMeta, []byte(id))
+	tx.Del(ccID, []byte(id))
+	tx.Del(ccPath, []byte(path))
+	return nil
+}
@@ -0,0 +1,396 @@
+/*
+ * Adam - Adam's a Data Access Manager
+ * Copyright (C) 2021 Nicolò Santamaria
+ *
+ * Adam is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Adam is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Kinds of operations that can be part of a transaction.
+const (
+	opPut    = "put"
+	opDel    = "del"
+	opRename = "rename"
+	opRemove = "remove"
+	opLink   = "link"
+)
+
+var (
+	// stores contains all the caches that can be modified by a transaction
+	// indexed by their name.
+	stores = make(map[string]*Cache)
+	// txMu serializes the transactions.
+	txMu sync.Mutex
+)
+
+// txOp is a single operation of a transaction.
+type txOp struct {
+	Kind    string `json:"kind"`
+	Store   string `json:"store,omitempty"`
+	Key     []byte `json:"key,omitempty"`
+	Val     []byte `json:"val,omitempty"`
+	Prev    []byte `json:"prev,omitempty"`
+	Existed bool   `json:"existed,omitempty"`
+	From    string `json:"from,omitempty"`
+	To      string `json:"to,omitempty"`
+}
+
+// isFS reports whether the operation acts on the filesystem.
+func (o txOp) isFS() bool {
+	return o.Kind == opRename || o.Kind == opRemove || o.Kind == opLink
+}
+
+// Txn is a group of operations on the caches and on the filesystem that are
+// either applied all together or not at all.
+// Before being applied the operations are written in a journal so that if
+// Adam stops halfway through a transaction it's completed on the next start.
+type Txn struct {
+	ops    []txOp
+	staged map[string][]byte
+	err    error
+}
+
+// update runs fn within a transaction and commits the operations staged by it.
+// If fn returns an error nothing is applied.
+func update(fn func(tx *Txn) error) error {
+	txMu.Lock()
+	defer txMu.Unlock()
+
+	tx := &Txn{staged: make(map[string][]byte)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if tx.err != nil {
+		return tx.err
+	}
+	return tx.commit()
+}
+
+// register adds the cache to the ones that can be modified by a transaction.
+func register(name string, c *Cache) {
+	stores[name] = c
+}
+
+func storeName(c *Cache) string {
+	for name, s := range stores {
+		if s == c {
+			return name
+		}
+	}
+	return ""
+}
+
+func stageKey(store string, key []byte) string {
+	return store + "\x00" + string(key)
+}
+
+// Get returns the value associated with key in the cache c taking into
+// account the operations already staged in the transaction.
+func (tx *Txn) Get(c *Cache, key []byte) ([]byte, error) {
+	if val, ok := tx.staged[stageKey(storeName(c), key)]; ok {
+		return val, nil
+	}
+	return c.Get(key)
+}
+
+func (tx *Txn) stage(kind string, c *Cache, key, val []byte) {
+	if tx.err != nil {
+		return
+	}
+
+	name := storeName(c)
+	if name == "" {
+		tx.err = errors.New("transaction on unregistered cache")
+		return
+	}
+
+	prev, err := tx.Get(c, key)
+	if err != nil {
+		tx.err = err
+		return
+	}
+
+	tx.ops = append(tx.ops, txOp{
+		Kind:    kind,
+		Store:   name,
+		Key:     key,
+		Val:     val,
+		Prev:    prev,
+		Existed: prev != nil,
+	})
+	tx.staged[stageKey(name, key)] = val
+}
+
+// Put stages the storing of val associated with key in the cache c.
+func (tx *Txn) Put(c *Cache, key, val []byte) {
+	tx.stage(opPut, c, key, val)
+}
+
+// Del stages the deletion of key from the cache c.
+func (tx *Txn) Del(c *Cache, key []byte) {
+	tx.stage(opDel, c, key, nil)
+}
+
+// Rename stages the renaming of the file or directory from into to,
+// creating the parent directories of to if needed.
+func (tx *Txn) Rename(from, to string) {
+	tx.ops = append(tx.ops, txOp{Kind: opRename, From: from, To: to})
+}
+
+// Link stages the creation of the hard link to pointing to from, creating the
+// parent directories of to if needed.
+func (tx *Txn) Link(from, to string) {
+	tx.ops = append(tx.ops, txOp{Kind: opLink, From: from, To: to})
+}
+
+// Remove stages the removal of the path and all its children.
+// Since removals can't be undone they should be the last operations.
+func (tx *Txn) Remove(path string) {
+	tx.ops = append(tx.ops, txOp{Kind: opRemove, To: path})
+}
+
+func journalDir() string {
+	return filepath.Join(cfg.CacheDir, "journal")
+}
+
+func (tx *Txn) commit() error {
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
+	j, err := openJournal(tx.ops)
+	if err != nil {
+		return fmt.Errorf("commit openJournal: %w", err)
+	}
+	defer j.remove()
+
+	for i, op := range tx.ops {
+		if err := op.apply(false); err != nil {
+			tx.rollback(i)
+			return fmt.Errorf("commit %s: %w", op.Kind, err)
+		}
+		if op.isFS() {
+			if err := j.done(i); err != nil {
+				tx.rollback(i + 1)
+				return fmt.Errorf("commit journal: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// rollback undoes the first n operations of the transaction.
+func (tx *Txn) rollback(n int) {
+	for i := n - 1; i >= 0; i-- {
+		if err := tx.ops[i].undo(); err != nil {
+			log.Println("rollback", tx.ops[i].Kind, err)
+		}
+	}
+}
+
+// apply executes the operation, if replay is true the filesystem operations
+// that were already carried out are skipped.
+func (o txOp) apply(replay bool) error {
+	switch o.Kind {
+	case opPut:
+		return stores[o.Store].Put(o.Key, o.Val)
+
+	case opDel:
+		return stores[o.Store].Del(o.Key)
+
+	case opRename:
+		if replay {
+			if ok, err := exists(o.From); err != nil || !ok {
+				return err
+			}
+		}
+		return renameSync(o.From, o.To)
+
+	case opRemove:
+		return removeSync(o.To)
+
+	case opLink:
+		if replay {
+			if ok, err := exists(o.To); err != nil || ok {
+				return err
+			}
+		}
+		return linkSync(o.From, o.To)
+
+	default:
+		return fmt.Errorf("unknown operation %q", o.Kind)
+	}
+}
+
+func (o txOp) undo() error {
+	switch o.Kind {
+	case opPut, opDel:
+		if o.Existed {
+			return stores[o.Store].Put(o.Key, o.Prev)
+		}
+		return stores[o.Store].Del(o.Key)
+
+	case opRename:
+		return renameSync(o.To, o.From)
+
+	case opLink:
+		return removeSync(o.To)
+
+	default:
+		return fmt.Errorf("cannot undo %s", o.Kind)
+	}
+}
+
+// journal is the file where the operations of a transaction are written
+// before being applied followed by the indexes of the filesystem operations
+// as soon as they're carried out.
+type journal struct {
+	*os.File
+}
+
+func openJournal(ops []txOp) (journal, error) {
+	if err := os.MkdirAll(journalDir(), 0755); err != nil {
+		return journal{}, err
+	}
+
+	b, err := json.Marshal(ops)
+	if err != nil {
+		return journal{}, err
+	}
+
+	// The name starts with the time so that the journals sort chronologically.
+	name := fmt.Sprintf("%020d-%s", time.Now().UnixNano(), uuid.New())
+	f, err := os.OpenFile(filepath.Join(journalDir(), name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return journal{}, err
+	}
+
+	j := journal{f}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		j.remove()
+		return journal{}, err
+	}
+	if err := f.Sync(); err != nil {
+		j.remove()
+		return journal{}, err
+	}
+	if err := syncDir(journalDir()); err != nil {
+		j.remove()
+		return journal{}, err
+	}
+	return j, nil
+}
+
+// done records that the i-th operation has been applied.
+func (j journal) done(i int) error {
+	if _, err := fmt.Fprintln(j, i); err != nil {
+		return err
+	}
+	return j.Sync()
+}
+
+func (j journal) remove() {
+	j.Close()
+	if err := os.Remove(j.Name()); err != nil {
+		log.Println("journal.remove", err)
+	}
+	// A journal that comes back to life after a crash would be replayed
+	// overwriting the changes made by the later transactions.
+	if err := syncDir(journalDir()); err != nil {
+		log.Println("journal.remove", err)
+	}
+}
+
+// replayJournal completes the transactions left unfinished by a previous run.
+func replayJournal() error {
+	entries, err := os.ReadDir(journalDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("replayJournal os.ReadDir: %w", err)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	for _, e := range entries {
+		path := filepath.Join(journalDir(), e.Name())
+		if err := replay(path); err != nil {
+			return fmt.Errorf("replayJournal %s: %w", e.Name(), err)
+		}
+		log.Println("replayed unfinished transaction", e.Name())
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("replayJournal os.Remove: %w", err)
+		}
+	}
+	return nil
+}
+
+func replay(path string) error {
+	var (
+		ops  []txOp
+		done = make(map[int]bool)
+	)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<30)
+	if !s.Scan() {
+		// The journal hasn't been completely written so none of the
+		// operations has been applied.
+		return s.Err()
+	}
+	if err := json.Unmarshal(s.Bytes(), &ops); err != nil {
+		// Same as above, the journal got truncated.
+		return nil
+	}
+	for s.Scan() {
+		if i, err := strconv.Atoi(s.Text()); err == nil {
+			done[i] = true
+		}
+	}
+
+	for i, op := range ops {
+		if op.isFS() && done[i] {
+			continue
+		}
+		if err := op.apply(true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+//go:build !solaris
+// +build !solaris
+
+/*
+ * Adam - Adam's a Data Access Manager
+ * Copyright (C) 2021 Nicolò Santamaria
+ *
+ * Adam is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Adam is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// Neither bitcask nor pogreb can start an iteration from a given key, so
+// the caches keep a sorted copy of their keys in memory to seek into.
+
+const (
+	// maxChunk is the maximum number of keys in a chunk of a keyIndex.
+	maxChunk = 512
+	// seekBatch is the number of keys Seek takes from the index at a time.
+	seekBatch = 256
+)
+
+// keyIndex keeps the keys of a cache sorted, split in chunks of at most
+// maxChunk keys so that adding or removing a key moves only the keys of its
+// chunk.
+// The writers hold the lock while changing both the cache and the index.
+type keyIndex struct {
+	sync.RWMutex
+	chunks [][][]byte
+}
+
+// newKeyIndex returns a keyIndex with the given keys, which are sorted in
+// place.
+func newKeyIndex(keys [][]byte) *keyIndex {
+	var x = &keyIndex{}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	for len(keys) > 0 {
+		n := maxChunk / 2
+		if n > len(keys) {
+			n = len(keys)
+		}
+		x.chunks = append(x.chunks, append([][]byte{}, keys[:n]...))
+		keys = keys[n:]
+	}
+	return x
+}
+
+// find returns the chunk and the position within it of the first key not
+// less than key, the chunk is len(x.chunks) if there's none.
+func (x *keyIndex) find(key []byte) (int, int) {
+	c := sort.Search(len(x.chunks), func(i int) bool {
+		chunk := x.chunks[i]
+		return bytes.Compare(chunk[len(chunk)-1], key) >= 0
+	})
+	if c == len(x.chunks) {
+		return c, 0
+	}
+
+	k := sort.Search(len(x.chunks[c]), func(i int) bool {
+		return bytes.Compare(x.chunks[c][i], key) >= 0
+	})
+	return c, k
+}
+
+// insert adds a copy of key to the index, the caller holds the lock.
+func (x *keyIndex) insert(key []byte) {
+	c, k := x.find(key)
+	switch {
+	case c < len(x.chunks) && bytes.Equal(x.chunks[c][k], key):
+		return
+	case len(x.chunks) == 0:
+		x.chunks = [][][]byte{nil}
+	case c == len(x.chunks):
+		// The key comes after all the others.
+		c--
+		k = len(x.chunks[c])
+	}
+
+	chunk := append(x.chunks[c], nil)
+	copy(chunk[k+1:], chunk[k:])
+	chunk[k] = append([]byte{}, key...)
+	x.chunks[c] = chunk
+
+	if len(chunk) > maxChunk {
+		half := len(chunk) / 2
+		x.chunks = append(x.chunks, nil)
+		copy(x.chunks[c+2:], x.chunks[c+1:])
+		x.chunks[c] = chunk[:half]
+		x.chunks[c+1] = append([][]byte{}, chunk[half:]...)
+	}
+}
+
+// remove deletes key from the index, the caller holds the lock.
+func (x *keyIndex) remove(key []byte) {
+	c, k := x.find(key)
+	if c == len(x.chunks) || !bytes.Equal(x.chunks[c][k], key) {
+		return
+	}
+
+	chunk := x.chunks[c]
+	copy(chunk[k:], chunk[k+1:])
+	chunk[len(chunk)-1] = nil
+	if chunk = chunk[:len(chunk)-1]; len(chunk) == 0 {
+		x.chunks = append(x.chunks[:c], x.chunks[c+1:]...)
+	} else {
+		x.chunks[c] = chunk
+	}
+}
+
+// seek returns in order at most n keys starting from the first one not less
+// than start.
+func (x *keyIndex) seek(start []byte, n int) [][]byte {
+	var keys [][]byte
+
+	x.RLock()
+	defer x.RUnlock()
+
+	for c, k := x.find(start); c < len(x.chunks) && len(keys) < n; c, k = c+1, 0 {
+		chunk := x.chunks[c][k:]
+		if m := n - len(keys); len(chunk) > m {
+			chunk = chunk[:m]
+		}
+		keys = append(keys, chunk...)
+	}
+	return keys
+}
+
+// Seek iterates in key order over the key-value pairs whose key isn't less
+// than start and calls the function in input passing those values as
+// argument.
+func (c *Cache) Seek(start []byte, fn func(key, val []byte) error) error {
+	for {
+		keys := c.keys.seek(start, seekBatch)
+
+		for _, k := range keys {
+			val, err := c.Get(k)
+			if err != nil {
+				return err
+			} else if val == nil {
+				// The key has been deleted in the meantime.
+				continue
+			}
+
+			if err := fn(k, val); err != nil {
+				if errors.Is(err, ErrIterationDone) {
+					return nil
+				}
+				return err
+			}
+		}
+
+		if len(keys) < seekBatch {
+			return nil
+		}
+		// The first key after the last one is the one followed by a zero
+		// byte.
+		start = append(append([]byte{}, keys[len(keys)-1]...), 0)
+	}
+}
@@ -0,0 +1,407 @@
+/*
+ * Adam - Adam's a Data Access Manager
+ * Copyright (C) 2021 Nicolò Santamaria
+ *
+ * Adam is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Adam is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Perm is a set of operations a client is allowed to perform.
+type Perm uint8
+
+const (
+	permRead Perm = 1 << iota
+	permWrite
+	permDelete
+	permMove
+	permMetaAdmin
+	permAdmin
+
+	permAll = permRead | permWrite | permDelete | permMove | permMetaAdmin | permAdmin
+)
+
+var permNames = []struct {
+	perm Perm
+	name string
+}{
+	{permRead, "read"},
+	{permWrite, "write"},
+	{permDelete, "delete"},
+	{permMove, "move"},
+	{permMetaAdmin, "meta-admin"},
+	{permAdmin, "admin"},
+}
+
+// parsePerm returns the Perm matching the given permission names.
+func parsePerm(names []string) (p Perm, err error) {
+outer:
+	for _, n := range names {
+		for _, pn := range permNames {
+			if n == pn.name {
+				p |= pn.perm
+				continue outer
+			}
+		}
+		return 0, fmt.Errorf("unknown permission %q", n)
+	}
+	return p, nil
+}
+
+// Names returns the names of the permissions in p.
+func (p Perm) Names() []string {
+	var names = []string{}
+
+	for _, pn := range permNames {
+		if p&pn.perm != 0 {
+			names = append(names, pn.name)
+		}
+	}
+	return names
+}
+
+func (p Perm) String() string {
+	return strings.Join(p.Names(), ", ")
+}
+
+// KeyConfig represents an API key defined in the configuration file, the key
+// can be provided either in clear or as its hex encoded sha256sum.
+type KeyConfig struct {
+	Name        string   `toml:"name"`
+	Key         string   `toml:"key"`
+	KeyHash     string   `toml:"key_hash"`
+	Permissions []string `toml:"permissions"`
+}
+
+// APIKey represents the json describing an API key.
+type APIKey struct {
+	Name        string    `json:"name"`
+	Permissions []string  `json:"permissions"`
+	Created     time.Time `json:"created,omitempty"`
+	Static      bool      `json:"static,omitempty"`
+}
+
+// principal is the identity of an authenticated client.
+type principal struct {
+	name string
+	perm Perm
+	// signed is true for the clients using a pre-signed URL, which are
+	// restricted to the path in target.
+	signed bool
+	target string
+}
+
+// anonymous is the principal of all the requests when no API key exists, it
+// can't manage the keys so that the first one must come from the
+// configuration file.
+var anonymous = principal{name: "anonymous", perm: permAll &^ permAdmin}
+
+var (
+	// ccKeys maps the sha256sum of the keys created via the /keys endpoint
+	// to their APIKey.
+	ccKeys *Cache
+	keysMu sync.RWMutex
+	// keys maps the sha256sum of all the API keys to their APIKey.
+	keys = make(map[string]APIKey)
+)
+
+// hashKey returns the hex encoded sha256sum of an API key.
+func hashKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// loadKeys loads the API keys from the configuration and from the cache.
+func loadKeys() error {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+
+	for _, k := range cfg.APIKeys {
+		if _, err := parsePerm(k.Permissions); err != nil {
+			return fmt.Errorf("loadKeys %s: %w", k.Name, err)
+		}
+
+		h := strings.ToLower(k.KeyHash)
+		if k.Key != "" {
+			h = hashKey(k.Key)
+		}
+		if h == "" {
+			return fmt.Errorf("loadKeys %s: missing key or key_hash", k.Name)
+		}
+
+		keys[h] = APIKey{
+			Name:        k.Name,
+			Permissions: k.Permissions,
+			Static:      true,
+		}
+	}
+
+	return ccKeys.Fold(func(h, v []byte) error {
+		var k APIKey
+
+		if err := json.Unmarshal(v, &k); err != nil {
+			return fmt.Errorf("loadKeys %s: %w", h, err)
+		}
+		keys[string(h)] = k
+		return nil
+	})
+}
+
+// findKey returns the hash of the key with the given name.
+func findKey(name string) (string, bool) {
+	for h, k := range keys {
+		if k.Name == name {
+			return h, true
+		}
+	}
+	return "", false
+}
+
+// authenticate returns the principal of the client sending the request with
+// a pre-signed URL, the X-Api-Key header, the Authorization header with the
+// Bearer scheme or its TLS certificate. Authentication is required only if
+// at least one API key exists.
+func authenticate(r *http.Request) (principal, error) {
+	if s, signed, err := parseSignedURL(r); err != nil {
+		return principal{}, err
+	} else if signed {
+		p := principal{name: "presigned", perm: permRead, signed: true, target: s.target}
+		if s.op == signPut {
+			p.perm, p.target = permWrite, filepath.FromSlash(s.target)
+			return p, nil
+		}
+
+		// The URLs for download are signed for an ID, which is resolved
+		// to the path of the file.
+		path, err := ccID.Get([]byte(s.target))
+		if err != nil {
+			return principal{}, err
+		}
+		p.target = string(path)
+		return p, nil
+	}
+
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+
+	key := r.Header.Get("X-Api-Key")
+	if a := r.Header.Get("Authorization"); key == "" && strings.HasPrefix(a, "Bearer ") {
+		key = strings.TrimPrefix(a, "Bearer ")
+	}
+
+	// Without an API key the client is identified by its certificate.
+	if key == "" || len(keys) == 0 {
+		if p, ok := clientPrincipal(r); ok {
+			return p, nil
+		}
+	}
+
+	if len(keys) == 0 {
+		return anonymous, nil
+	} else if key == "" {
+		return principal{}, errorf(http.StatusUnauthorized, "missing API key")
+	}
+
+	k, ok := keys[hashKey(key)]
+	if !ok {
+		return principal{}, errorf(http.StatusUnauthorized, "invalid API key")
+	}
+
+	// The permissions have been validated when loading the key.
+	perm, _ := parsePerm(k.Permissions)
+	return principal{name: k.Name, perm: perm}, nil
+}
+
+// authorize returns an error if the client sending the request isn't allowed
+// to perform all the operations in perm on each of the given paths.
+func authorize(r *http.Request, perm Perm, paths ...string) error {
+	p, err := authenticate(r)
+	if err != nil {
+		return err
+	}
+
+	if p.perm&perm != perm {
+		return errorf(http.StatusForbidden, "%s is not allowed to %s", p.name, perm&^p.perm)
+	}
+
+	for _, path := range paths {
+		if !p.can(perm, path) {
+			return errorf(http.StatusForbidden, "%s is not allowed to %s %s", p.name, perm, path)
+		}
+	}
+	return nil
+}
+
+// allow replies with an error and returns false if the client sending the
+// request isn't allowed to perform all the operations in perm on each of
+// the given paths.
+func allow(w http.ResponseWriter, r *http.Request, perm Perm, paths ...string) bool {
+	if err := authorize(r, perm, paths...); err != nil {
+		if asError(err).Status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="adam"`)
+		}
+		fail(w, err)
+		return false
+	}
+	return true
+}
+
+// createKey generates a new API key, saves its hash and returns it in clear.
+func createKey(name string, perm Perm) (string, APIKey, error) {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+
+	if _, ok := findKey(name); ok {
+		return "", APIKey{}, errorf(http.StatusConflict, "key %s already exists", name)
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", APIKey{}, fmt.Errorf("createKey rand.Read: %w", err)
+	}
+
+	var (
+		key = base64.RawURLEncoding.EncodeToString(b)
+		h   = hashKey(key)
+		k   = APIKey{
+			Name:        name,
+			Permissions: perm.Names(),
+			Created:     time.Now(),
+		}
+	)
+
+	v, err := json.Marshal(k)
+	if err != nil {
+		return "", APIKey{}, fmt.Errorf("createKey json.Marshal: %w", err)
+	}
+	if err := ccKeys.Put([]byte(h), v); err != nil {
+		return "", APIKey{}, fmt.Errorf("createKey ccKeys.Put: %w", err)
+	}
+
+	keys[h] = k
+	return key, k, nil
+}
+
+// revokeKey deletes the key with the given name.
+func revokeKey(name string) error {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+
+	h, ok := findKey(name)
+	if !ok {
+		return errorf(http.StatusNotFound, "no key named %s", name)
+	} else if keys[h].Static {
+		return errorf(http.StatusConflict, "key %s is defined in the configuration file", name)
+	}
+
+	if err := ccKeys.Del([]byte(h)); err != nil {
+		return fmt.Errorf("revokeKey ccKeys.Del: %w", err)
+	}
+	delete(keys, h)
+	return nil
+}
+
+// listKeys returns all the API keys sorted by name.
+func listKeys() []APIKey {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+
+	var list = []APIKey{}
+	for _, k := range keys {
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+func handleKeys(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	if !allow(w, r, permAdmin) {
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/keys")
+	name = strings.TrimPrefix(name, "/")
+
+	switch r.Method {
+	case http.MethodGet:
+		reply(w, http.StatusOK, KeysResponse{
+			Base: Base{OK: true},
+			Keys: listKeys(),
+		})
+
+	case http.MethodPost:
+		var req KeyRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Println("handleKeys", "json.Decoder.Decode", err)
+			fail(w, errorf(http.StatusBadRequest, "%v", err))
+			return
+		}
+		if req.Name == "" {
+			fail(w, errorf(http.StatusBadRequest, "missing key name"))
+			return
+		}
+
+		perm, err := parsePerm(req.Permissions)
+		if err != nil {
+			fail(w, errorf(http.StatusBadRequest, "%v", err))
+			return
+		}
+
+		key, k, err := createKey(req.Name, perm)
+		if err != nil {
+			log.Println("handleKeys", err)
+			fail(w, err)
+			return
+		}
+		reply(w, http.StatusCreated, KeyResponse{
+			Base:   Base{OK: true},
+			Key:    k,
+			Secret: key,
+		})
+
+	case http.MethodDelete:
+		if name == "" {
+			fail(w, errorf(http.StatusBadRequest, "missing key name"))
+			return
+		}
+		if err := revokeKey(name); err != nil {
+			log.Println("handleKeys", err)
+			fail(w, err)
+			return
+		}
+		reply(w, http.StatusOK, Base{OK: true})
+	}
+}
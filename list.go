@@ -38,21 +38,21 @@ func (s *StrList) Slice() []string {
 	return s.s
 }
 
-// ErrList is an error slice safe for concurrent use.
+// ErrList is a FileError slice safe for concurrent use.
 type ErrList struct {
-	e []error
+	e []FileError
 	sync.Mutex
 }
 
-// Append appends the given error to the slice.
-func (e *ErrList) Append(a ...error) {
+// Append appends the given errors to the slice.
+func (e *ErrList) Append(a ...FileError) {
 	e.Lock()
 	e.e = append(e.e, a...)
 	e.Unlock()
 }
 
-// Slice returns the underlying error slice.
-func (e *ErrList) Slice() []error {
+// Slice returns the underlying FileError slice.
+func (e *ErrList) Slice() []FileError {
 	return e.e
 }
 
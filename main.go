@@ -19,7 +19,7 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
@@ -29,12 +29,16 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
@@ -42,21 +46,10 @@ import (
 
 var (
 	cfg    Config
-	ccHash Cache
-	ccID   Cache
+	ccHash *Cache
+	ccID   *Cache
 )
 
-// Returns the Base object with ok=false and the error message encoded in Json.
-func errorf(format string, a ...interface{}) string {
-	base := Base{false, fmt.Sprintf(format, a...)}
-	b, err := json.Marshal(base)
-	if err != nil {
-		log.Println("errorf", "json.Marshal", err)
-		return "internal server error, check logs for details"
-	}
-	return string(b)
-}
-
 func exists(path string) (bool, error) {
 	if _, err := os.Stat(path); err != nil {
 		if os.IsNotExist(err) {
@@ -67,291 +60,502 @@ func exists(path string) (bool, error) {
 	return true, nil
 }
 
-func saveFile(fpath string, content []byte) error {
-	var dir = filepath.Dir(fpath)
+// internalDir is the directory inside the base directory where Adam keeps
+// its own data.
+const internalDir = ".adam"
+
+// internalMarker is the file that marks the internal directory as Adam's.
+const internalMarker = "adam-internal"
+
+// internalEntries are the directories Adam creates in its internal directory.
+var internalEntries = map[string]bool{
+	"blobs":     true,
+	"snapshots": true,
+	"tmp":       true,
+	"trash":     true,
+	"uploads":   true,
+	"versions":  true,
+}
 
-	// If the directory doesn't exist we create it.
-	if ok, err := exists(dir); !ok && err == nil {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return err
-		}
-	} else if err != nil {
+// checkInternalDir makes sure that the internal directory belongs to Adam,
+// since the paths inside it are hidden from the clients a directory with the
+// same name made by the users must be moved elsewhere before starting Adam.
+// The internal directories of the older versions of Adam, which weren't
+// marked, are recognized by their content.
+func checkInternalDir() error {
+	var (
+		dir    = filepath.Join(cfg.BaseDir, internalDir)
+		marker = filepath.Join(dir, internalMarker)
+	)
+
+	if ok, err := exists(marker); err != nil || ok {
 		return err
 	}
-	if err := os.WriteFile(fpath, content, 0644); err != nil {
-		return err
+
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("checkInternalDir: %w", err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() || !internalEntries[e.Name()] {
+			return fmt.Errorf("checkInternalDir: %s is reserved to Adam but contains %s, move it out of the base directory", dir, e.Name())
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("checkInternalDir: %w", err)
+	}
+	if err := os.WriteFile(marker, nil, 0644); err != nil {
+		return fmt.Errorf("checkInternalDir: %w", err)
 	}
 	return nil
 }
 
-func saveSha256sum(fpath string, cnt []byte) (string, error) {
-	h := sha256.New()
-	if _, err := io.Copy(h, bytes.NewReader(cnt)); err != nil {
-		return "", err
+// tempFile creates a new file in Adam's temporary directory, which lives in
+// the base directory so that its content can be renamed into place.
+func tempFile() (*os.File, error) {
+	dir := filepath.Join(cfg.BaseDir, internalDir, "tmp")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
 	}
+	return os.CreateTemp(dir, "adam-")
+}
 
-	encHex := hex.EncodeToString(h.Sum(nil))
-	if err := ccHash.Put([]byte(fpath), []byte(encHex)); err != nil {
-		return "", err
-	}
-	return encHex, nil
+// tempPath returns a path in Adam's temporary directory that doesn't exist yet.
+func tempPath() string {
+	return filepath.Join(cfg.BaseDir, internalDir, "tmp", uuid.New().String())
 }
 
-func moveSha256sum(src, dest string) error {
-	var s = []byte(src)
-	var d = []byte(dest)
+// upload represents the content of a file received in a temporary file.
+type upload struct {
+	tmp      string
+	hash     string
+	size     int64
+	uploader string
+	meta     *Meta
+}
+
+// receive streams r into a temporary file computing its checksum on the fly.
+func receive(r io.Reader) (upload, error) {
+	return receiveMax(r, cfg.MaxUploadSize)
+}
 
-	hash, err := ccHash.Get(s)
+// receiveMax is like receive but fails if r is larger than max bytes, a max
+// of 0 means no limit.
+func receiveMax(r io.Reader, max int64) (upload, error) {
+	f, err := tempFile()
 	if err != nil {
-		return err
+		return upload{}, err
 	}
-	if err := ccHash.Del(s); err != nil {
-		return err
+	defer f.Close()
+
+	// One byte more than the limit is read to tell whether it's exceeded.
+	if max > 0 {
+		r = io.LimitReader(r, max+1)
 	}
-	if err := ccHash.Put(d, hash); err != nil {
-		return err
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err == nil && max > 0 && n > max {
+		err = errorf(http.StatusRequestEntityTooLarge, "file exceeds the maximum size of %d bytes", max)
 	}
-	return nil
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return upload{}, err
+	}
+
+	return upload{
+		tmp:  f.Name(),
+		hash: hex.EncodeToString(h.Sum(nil)),
+		size: n,
+	}, nil
 }
 
-func findIDFromPath(path string) (string, error) {
-	var id []byte
+// hashFile returns the hex encoded sha256sum of the file at path.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
 
-	return string(id), ccID.Fold(func(key, val []byte) error {
-		if string(val) == path {
-			id = key
-			return ErrIterationDone
-		}
-		return nil
-	})
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-func saveData(id, fpath string, content []byte) (File, error) {
-	var path = filepath.Join(cfg.BaseDir, fpath)
+// saveData moves the uploaded content to fpath and associates it with id.
+func saveData(id, fpath string, u upload) (File, error) {
+	// If everything goes well the temporary file is already gone.
+	defer os.Remove(u.tmp)
 
-	// Save file to disk.
-	if err := saveFile(path, content); err != nil {
-		return File{}, fmt.Errorf("put saveFile: %w", err)
+	fpath, err := sanitize(fpath)
+	if err != nil {
+		return File{}, fmt.Errorf("put sanitize: %w", err)
 	}
 
-	// Save ID to cache.
-	if err := ccID.Put([]byte(id), []byte(fpath)); err != nil {
-		return File{}, fmt.Errorf("put ccID.Put: %w", err)
-	}
+	var (
+		path = filepath.Join(cfg.BaseDir, fpath)
+		now  = time.Now().UTC()
+		file = File{
+			ID:        id,
+			Sha256sum: u.hash,
+			Path:      fpath,
+			Stat: &Stat{
+				Size:     u.size,
+				MIME:     detectMIME(fpath, u.tmp),
+				Created:  now,
+				Modified: now,
+				Uploader: u.uploader,
+			},
+			Meta: u.meta,
+		}
+	)
+
+	err = update(func(tx *Txn) error {
+		var (
+			stash   string
+			garbage []string
+		)
 
-	// Save sha256sum to cache.
-	hash, err := saveSha256sum(fpath, content)
+		info, err := os.Stat(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		// The ID and the checksum of the old content are read before being
+		// replaced.
+		oldID, err := tx.Get(ccPath, []byte(fpath))
+		if err != nil {
+			return err
+		}
+		oldHash, err := tx.Get(ccHash, []byte(fpath))
+		if err != nil {
+			return err
+		}
+
+		// Overwriting a file keeps its creation time.
+		if old, err := tx.Get(ccStat, []byte(id)); err != nil {
+			return err
+		} else if old != nil {
+			var s Stat
+			if err := json.Unmarshal(old, &s); err == nil {
+				file.Created = s.Created
+			}
+		}
+		// Without new metadata the one of the overwritten file is kept.
+		if file.Meta == nil {
+			if old, err := tx.Get(ccMeta, []byte(id)); err != nil {
+				return err
+			} else if old != nil {
+				var m Meta
+				if err := json.Unmarshal(old, &m); err == nil {
+					file.Meta = &m
+				}
+			}
+		}
+
+		if info != nil {
+			if info.IsDir() {
+				return errorf(http.StatusConflict, "%s is a directory", fpath)
+			}
+
+			if string(oldID) == id && cfg.MaxVersions != 0 {
+				// The old content becomes the latest version of the file.
+				if garbage, err = archive(tx, id, path, string(oldHash), info); err != nil {
+					return err
+				}
+			} else {
+				// The old content is kept aside until the transaction is
+				// committed so that it can be put back in place in case of
+				// errors.
+				stash = tempPath()
+				tx.Rename(path, stash)
+			}
+		}
+
+		if cfg.Dedup {
+			if err := linkBlob(tx, u, path); err != nil {
+				return err
+			}
+		} else {
+			tx.Rename(u.tmp, path)
+		}
+		// The reference of the old content is released after the new one is
+		// taken so that a blob shared by both is never removed.
+		if stash != "" {
+			blob, err := unlinkBlob(tx, path, string(oldHash))
+			if err != nil {
+				return err
+			} else if blob != "" {
+				garbage = append(garbage, blob)
+			}
+		}
+		// The history of a file replaced by one with another ID is lost.
+		if oldID != nil && string(oldID) != id {
+			g, err := dropVersions(tx, string(oldID))
+			if err != nil {
+				return err
+			}
+			garbage = append(garbage, g...)
+		}
+		if err := indexFile(tx, file); err != nil {
+			return err
+		}
+		if err := logSave(tx, string(oldID), file); err != nil {
+			return err
+		}
+		if stash != "" {
+			tx.Remove(stash)
+		}
+		for _, g := range garbage {
+			tx.Remove(g)
+		}
+		return nil
+	})
 	if err != nil {
-		return File{}, fmt.Errorf("put saveSha256sum: %w", err)
+		return File{}, fmt.Errorf("put update: %w", err)
 	}
 
-	return File{ID: id, Sha256sum: hash, Path: fpath}, nil
+	return file, nil
 }
 
-func put(fname string, content []byte) (File, error) {
-	var (
-		id   string
-		path = filepath.Join(cfg.BaseDir, fname)
-	)
+func put(fname string, u upload) (File, error) {
+	// Reuse the ID if fname already exists, otherwise generate a new UUID.
+	id, err := findIDFromPath(fname)
+	if err != nil {
+		os.Remove(u.tmp)
+		return File{}, fmt.Errorf("put findIDFromPath: %w", err)
+	}
 
-	// Generate UUID if fname doesn't exist.
-	if ok, err := exists(path); err != nil {
-		return File{}, fmt.Errorf("put exists: %w", err)
-	} else if ok {
-		if id, err = findIDFromPath(fname); err != nil {
-			return File{}, fmt.Errorf("put findIDFromPath: %w", err)
-		}
-	} else {
+	if id == "" {
 		ident, err := uuid.NewRandom()
 		if err != nil {
+			os.Remove(u.tmp)
 			return File{}, fmt.Errorf("put uuid.NewRandom: %w", err)
 		}
 		id = ident.String()
 	}
 
-	return saveData(id, fname, content)
+	return saveData(id, fname, u)
 }
 
 func del(fpath string) error {
+	fpath, err := sanitize(fpath)
+	if err != nil {
+		return fmt.Errorf("del sanitize: %w", err)
+	}
+
 	var abs = filepath.Join(cfg.BaseDir, fpath)
 
-	if err := os.RemoveAll(abs); err != nil {
-		return fmt.Errorf("del os.RemoveAll: %w", err)
+	if ok, err := exists(abs); err != nil {
+		return fmt.Errorf("del exists: %w", err)
+	} else if !ok {
+		return fmt.Errorf("del: %w", errorf(http.StatusNotFound, "%s not found", fpath))
 	}
 
-	// We delete all the occurrences that have 'fpath' as prefix.
-	deletable := make(map[string]string)
-	ccID.Fold(func(id, path []byte) error {
-		if strings.HasPrefix(string(path), fpath) {
-			deletable[string(id)] = string(path)
-		}
-		return nil
+	err = update(func(tx *Txn) error {
+		// All the occurrences contained in 'fpath' are moved to the trash.
+		return moveToTrash(tx, fpath)
 	})
-
-	for id, path := range deletable {
-		i := []byte(id)
-		p := []byte(path)
-
-		if err := ccHash.Del(p); err != nil {
-			log.Println("del", "ccHash.Del", err)
-		}
-		if err := ccID.Del(i); err != nil {
-			log.Println("del", "ccID.Del", err)
-		}
+	if err != nil {
+		return fmt.Errorf("del update: %w", err)
 	}
-
 	return nil
 }
 
 func move(oldpath, newpath string) error {
-	var wg sync.WaitGroup
+	oldpath, err := sanitize(oldpath)
+	if err != nil {
+		return fmt.Errorf("move sanitize: %w", err)
+	}
+	newpath, err = sanitize(newpath)
+	if err != nil {
+		return fmt.Errorf("move sanitize: %w", err)
+	}
 
-	absDest := filepath.Join(cfg.BaseDir, newpath)
-	destDir := filepath.Dir(absDest)
+	var (
+		absSrc  = filepath.Join(cfg.BaseDir, oldpath)
+		absDest = filepath.Join(cfg.BaseDir, newpath)
+	)
 
-	// Create destination directory if doesn't exist.
-	if ok, err := exists(destDir); !ok && err == nil {
-		if err := os.MkdirAll(destDir, 0755); err != nil {
-			return fmt.Errorf("move os.MkdirAll: %w", err)
-		}
-	} else if err != nil {
+	if ok, err := exists(absSrc); err != nil {
 		return fmt.Errorf("move exists: %w", err)
+	} else if !ok {
+		return fmt.Errorf("move: %w", errorf(http.StatusNotFound, "%s not found", oldpath))
 	}
 
-	absSrc := filepath.Join(cfg.BaseDir, oldpath)
-
-	if err := os.Rename(absSrc, absDest); err != nil {
-		return fmt.Errorf("move os.Rename: %w", err)
+	// Moving never replaces existing content, the destination must be freed
+	// with an explicit delete first.
+	if ok, err := exists(absDest); err != nil {
+		return fmt.Errorf("move exists: %w", err)
+	} else if ok {
+		return fmt.Errorf("move: %w", errorf(http.StatusConflict, "%s already exists", newpath))
 	}
 
-	// Update the IDs in the cache.
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-
-		affected := make(map[string]string)
-		ccID.Fold(func(k, v []byte) error {
-			id := string(k)
-			path := string(v)
-
-			if strings.HasPrefix(path, oldpath) {
-				affected[id] = strings.Replace(path, oldpath, newpath, -1)
-			}
-
-			return nil
-		})
-
-		for id, path := range affected {
-			if err := ccID.Put([]byte(id), []byte(path)); err != nil {
-				log.Println("move", "ccID.Put", err)
-			}
+	err = update(func(tx *Txn) error {
+		affected, err := subtree(oldpath)
+		if err != nil {
+			return err
 		}
-	}()
 
-	// Update the checksums of the files.
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
+		tx.Rename(absSrc, absDest)
 
-		affected := make(map[string]File)
-		ccHash.Fold(func(path, hash []byte) error {
-			p := string(path)
-			h := string(hash)
+		// Update the IDs, the paths and the checksums in the caches.
+		for old, id := range affected {
+			new := newpath + strings.TrimPrefix(old, oldpath)
+			o := []byte(old)
+			n := []byte(new)
 
-			if strings.HasPrefix(p, oldpath) {
-				new := strings.Replace(p, oldpath, newpath, -1)
-				affected[p] = File{Sha256sum: h, Path: new}
+			hash, err := tx.Get(ccHash, o)
+			if err != nil {
+				return err
 			}
-			return nil
-		})
 
-		for old, file := range affected {
-			if err := ccHash.Del([]byte(old)); err != nil {
-				log.Println("move", "ccHash.Del", err)
+			tx.Del(ccPath, o)
+			tx.Del(ccHash, o)
+			tx.Put(ccID, []byte(id), n)
+			tx.Put(ccPath, n, []byte(id))
+			if hash != nil {
+				tx.Put(ccHash, n, hash)
 			}
-			if err := ccHash.Put([]byte(file.Path), []byte(file.Sha256sum)); err != nil {
-				log.Println("move", "ccHash.Put", err)
+
+			err = logChange(tx, Change{Op: changeMove, ID: id, Path: new, From: old, Sha256sum: string(hash)})
+			if err != nil {
+				return err
 			}
 		}
-	}()
-
-	wg.Wait()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("move update: %w", err)
+	}
 	return nil
 }
 
-func restore(files []File) (errs []error) {
+func restore(files []File) (errs []FileError) {
 	for _, f := range files {
-		if err := ccID.Put([]byte(f.ID), []byte(f.Path)); err != nil {
-			e := fmt.Errorf("unable to restore ID for %s: %w\n", f.Path, err)
-			errs = append(errs, e)
+		path, err := sanitize(f.Path)
+		if err != nil {
+			errs = append(errs, fileError(f.Path, err))
+			continue
+		}
+		f.Path = path
+
+		if err := checkID(f.ID); err != nil {
+			errs = append(errs, fileError(f.Path, err))
+			continue
 		}
-		if err := ccHash.Put([]byte(f.Path), []byte(f.Sha256sum)); err != nil {
-			e := fmt.Errorf("unable to restore sha256sum for %s: %w\n", f.Path, err)
-			errs = append(errs, e)
+		if err := f.Meta.normalize(); err != nil {
+			errs = append(errs, fileError(f.Path, err))
+			continue
+		}
+
+		err = update(func(tx *Txn) error {
+			if err := indexFile(tx, f); err != nil {
+				return err
+			}
+			return logChange(tx, Change{Op: changeRestore, ID: f.ID, Path: f.Path, Sha256sum: f.Sha256sum})
+		})
+		if err != nil {
+			e := fmt.Errorf("unable to restore: %w", err)
+			errs = append(errs, fileError(f.Path, e))
 		}
 	}
 	return
 }
 
-func restoreFile(fpath string) []error {
+func restoreFile(fpath string) []FileError {
 	var files []File
 
 	b, err := os.ReadFile(fpath)
 	if err != nil {
-		return []error{err}
+		return []FileError{fileError(fpath, err)}
 	}
 
 	if err := json.Unmarshal(b, &files); err != nil {
-		return []error{err}
+		return []FileError{fileError(fpath, err)}
 	}
 
 	return restore(files)
 }
 
 func handleGet(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		fmt.Fprintln(w, errorf("invalid request, expected GET got %s", r.Method))
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	if !allow(w, r, permRead) {
 		return
 	}
 
 	values, err := url.ParseQuery(r.URL.RawQuery)
 	if err != nil {
 		log.Println("handleGet", "url.ParseQuery", err)
-		fmt.Fprintln(w, errorf(err.Error()))
+		fail(w, errorf(http.StatusBadRequest, "%v", err))
 		return
 	}
 
 	id := values.Get("id")
 	if id == "" {
-		fmt.Fprintln(w, errorf("missing id query parameter"))
+		fail(w, errorf(http.StatusBadRequest, "missing id query parameter"))
 		return
 	}
 
 	path, err := ccID.Get([]byte(id))
 	if err != nil {
 		log.Println("handleGet", "ccID.Get", err)
-		fmt.Fprintln(w, errorf(err.Error()))
+		fail(w, err)
+		return
+	} else if path == nil {
+		fail(w, errorf(http.StatusNotFound, "no path with id %s", id))
+		return
+	}
+
+	if !allow(w, r, permRead, string(path)) {
 		return
 	}
 
+	// With the version query parameter the past version is returned instead
+	// of the current content.
+	if v := values.Get("version"); v != "" {
+		n, err := parseVersion(v)
+		if err != nil {
+			fail(w, err)
+			return
+		}
+
+		ver, err := version(id, n)
+		if err != nil {
+			log.Println("handleGet", "version", err)
+			fail(w, err)
+			return
+		} else if ver == nil {
+			fail(w, errorf(http.StatusNotFound, "no version %d of id %s", n, id))
+			return
+		}
+		http.ServeFile(w, r, versionPath(id, n))
+		return
+	}
 	http.ServeFile(w, r, filepath.Join(cfg.BaseDir, string(path)))
 }
 
 func handlePut(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		fmt.Fprintln(w, errorf("invalid request, expected POST got %s", r.Method))
+	if !checkMethod(w, r, http.MethodPost) {
 		return
 	}
-
-	// 1Mb in memory the rest on disk.
-	r.ParseMultipartForm(1_048_576)
-	if r.MultipartForm == nil {
-		fmt.Fprintln(w, errorf("no file provided"))
+	if !allow(w, r, permWrite) {
 		return
 	}
 
-	if len(r.MultipartForm.File) == 0 {
-		fmt.Fprintln(w, errorf("no file provided"))
+	// The parts are streamed straight to disk without buffering them.
+	mr, err := r.MultipartReader()
+	if err != nil {
+		fail(w, errorf(http.StatusBadRequest, "no file provided"))
 		return
 	}
 
@@ -359,60 +563,111 @@ func handlePut(w http.ResponseWriter, r *http.Request) {
 		wg    sync.WaitGroup
 		files FileList
 		errs  ErrList
-		ok    = true
+		nfile int
+		meta  *Meta
 	)
 
-	for _, headers := range r.MultipartForm.File {
-		for _, h := range headers {
-			tmp, err := h.Open()
-			if err != nil {
-				log.Println("handlePut", "h.Open", err)
-				continue
-			}
+	fdir := strings.TrimPrefix(r.URL.Path, "/put")
+	fdir = strings.TrimPrefix(fdir, "/")
+
+	// The constraints of the pre-signed URL, if any, have already been
+	// validated along with its signature.
+	signed, _, _ := parseSignedURL(r)
+	max := cfg.MaxUploadSize
+	if signed.maxSize > 0 && (max == 0 || signed.maxSize < max) {
+		max = signed.maxSize
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Println("handlePut", "mr.NextPart", err)
+			errs.Append(fileError("", errorf(http.StatusBadRequest, "%v", err)))
+			break
+		}
 
-			fname := filepath.Base(h.Filename)
-			cnt, err := io.ReadAll(tmp)
-			tmp.Close()
+		if part.FileName() == "" {
+			// The metadata in the meta field applies to the files after it.
+			if part.FormName() == "meta" {
+				meta, err = decodeMeta(part)
+			}
+			part.Close()
 			if err != nil {
-				log.Println("handlePut", "io.ReadAll", err)
-				continue
+				errs.Append(fileError("", err))
+				break
 			}
+			continue
+		}
+		nfile++
+
+		// A name like .. would point outside the directory of the URL.
+		name := filepath.Base(part.FileName())
+		if err := checkName(name); err != nil {
+			part.Close()
+			errs.Append(fileError(part.FileName(), err))
+			continue
+		}
 
-			fdir := strings.TrimPrefix(r.URL.Path, "/put")
-			fdir = strings.TrimPrefix(fdir, "/")
-			fpath := filepath.Join(fdir, fname)
-			wg.Add(1)
-			go func(fpath string, cnt []byte) {
-				defer wg.Done()
-
-				if file, err := put(fpath, cnt); err == nil {
-					files.Append(file)
-				} else {
-					ok = false
-					log.Println("handlePut", err)
-					errs.Append(errors.Unwrap(err))
-				}
-			}(fpath, cnt)
+		fpath, err := sanitize(filepath.Join(fdir, name))
+		if err != nil {
+			part.Close()
+			errs.Append(fileError(part.FileName(), err))
+			continue
+		}
+		if err := authorize(r, permWrite, fpath); err != nil {
+			part.Close()
+			errs.Append(fileError(fpath, err))
+			continue
+		}
+		if err := signed.checkContentType(part.Header.Get("Content-Type")); err != nil {
+			part.Close()
+			errs.Append(fileError(fpath, err))
+			continue
 		}
-		wg.Wait()
 
-		b, err := json.Marshal(PutResponse{
-			Base:   Base{OK: ok},
-			Files:  files.Slice(),
-			Errors: errs.Slice(),
-		})
+		u, err := receiveMax(part, max)
+		part.Close()
 		if err != nil {
-			log.Println("handlePut", "json.Marshal", err)
-			fmt.Fprintln(w, errorf(err.Error()))
-			return
+			log.Println("handlePut", "receive", err)
+			errs.Append(fileError(fpath, err))
+			continue
 		}
-		fmt.Fprintln(w, string(b))
+		u.uploader = uploader(r)
+		u.meta = meta
+
+		wg.Add(1)
+		go func(fpath string, u upload) {
+			defer wg.Done()
+
+			if file, err := put(fpath, u); err == nil {
+				files.Append(file)
+			} else {
+				log.Println("handlePut", err)
+				errs.Append(fileError(fpath, errors.Unwrap(err)))
+			}
+		}(fpath, u)
 	}
+	wg.Wait()
+
+	if nfile == 0 && len(errs.Slice()) == 0 {
+		fail(w, errorf(http.StatusBadRequest, "no file provided"))
+		return
+	}
+
+	reply(w, putStatus(files.Slice(), errs.Slice()), PutResponse{
+		Base:   Base{OK: len(errs.Slice()) == 0},
+		Files:  files.Slice(),
+		Errors: errs.Slice(),
+	})
 }
 
 func handleDel(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		fmt.Fprintln(w, errorf("invalid request, expected GET got %s", r.Method))
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	if !allow(w, r, permDelete) {
 		return
 	}
 
@@ -422,23 +677,23 @@ func handleDel(w http.ResponseWriter, r *http.Request) {
 		values, err := url.ParseQuery(r.URL.RawQuery)
 		if err != nil {
 			log.Println("handleDel", "url.ParseQuery", err)
-			fmt.Fprintln(w, errorf(err.Error()))
+			fail(w, errorf(http.StatusBadRequest, "%v", err))
 			return
 		}
 
 		id := values.Get("id")
 		if id == "" {
-			fmt.Fprintln(w, errorf("missing id query parameter or path"))
+			fail(w, errorf(http.StatusBadRequest, "missing id query parameter or path"))
 			return
 		}
 
 		r, err := ccID.Get([]byte(id))
 		if err != nil {
-			log.Println("handleDel", "url.ParseQuery", err)
-			fmt.Fprintln(w, errorf(err.Error()))
+			log.Println("handleDel", "ccID.Get", err)
+			fail(w, err)
 			return
 		} else if r == nil {
-			fmt.Fprintln(w, errorf("no path with id %s", id))
+			fail(w, errorf(http.StatusNotFound, "no path with id %s", id))
 			return
 		}
 		relative = string(r)
@@ -446,32 +701,30 @@ func handleDel(w http.ResponseWriter, r *http.Request) {
 		relative = strings.TrimPrefix(relative, "/")
 	}
 
+	if !allow(w, r, permDelete, relative) {
+		return
+	}
 	if err := del(relative); err != nil {
 		log.Println("handleDel", err)
-		err = errors.Unwrap(err)
-		fmt.Fprintln(w, errorf(err.Error()))
+		fail(w, errors.Unwrap(err))
 		return
 	}
 
-	b, err := json.Marshal(Base{OK: true})
-	if err != nil {
-		log.Println("handleDel", "json.Marshal", err)
-		fmt.Fprintln(w, errorf(err.Error()))
-		return
-	}
-	fmt.Fprintln(w, string(b))
+	reply(w, http.StatusOK, Base{OK: true})
 }
 
 func handleMove(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		fmt.Fprintln(w, errorf("invalid request, expected GET got %s", r.Method))
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	if !allow(w, r, permMove) {
 		return
 	}
 
 	values, err := url.ParseQuery(r.URL.RawQuery)
 	if err != nil {
 		log.Println("handleMove", "url.ParseQuery", err)
-		fmt.Fprintln(w, errorf(err.Error()))
+		fail(w, errorf(http.StatusBadRequest, "%v", err))
 		return
 	}
 
@@ -479,17 +732,17 @@ func handleMove(w http.ResponseWriter, r *http.Request) {
 	if oldpath == "" {
 		id := values.Get("id")
 		if id == "" {
-			fmt.Fprintln(w, errorf("missing either oldpath or id query parameter"))
+			fail(w, errorf(http.StatusBadRequest, "missing either oldpath or id query parameter"))
 			return
 		}
 
 		p, err := ccID.Get([]byte(id))
 		if err != nil {
 			log.Println("handleMove", "ccID.Get", err)
-			fmt.Fprintln(w, errorf(err.Error()))
+			fail(w, err)
 			return
 		} else if p == nil {
-			fmt.Fprintln(w, errorf("no path with id %s", id))
+			fail(w, errorf(http.StatusNotFound, "no path with id %s", id))
 			return
 		}
 		oldpath = string(p)
@@ -497,29 +750,27 @@ func handleMove(w http.ResponseWriter, r *http.Request) {
 
 	newpath := values.Get("newpath")
 	if newpath == "" {
-		fmt.Fprintln(w, errorf("missing newpath query parameter"))
+		fail(w, errorf(http.StatusBadRequest, "missing newpath query parameter"))
 		return
 	}
 
+	if !allow(w, r, permMove, oldpath, newpath) {
+		return
+	}
 	if err := move(oldpath, newpath); err != nil {
 		log.Println("handleMove", err)
-		err = errors.Unwrap(err)
-		fmt.Fprintln(w, errorf(err.Error()))
+		fail(w, errors.Unwrap(err))
 		return
 	}
 
-	b, err := json.Marshal(Base{OK: true})
-	if err != nil {
-		log.Println("handleMove", "json.Marshal", err)
-		fmt.Fprintln(w, errorf(err.Error()))
-		return
-	}
-	fmt.Fprintln(w, string(b))
+	reply(w, http.StatusOK, Base{OK: true})
 }
 
 func handleSha256sum(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		fmt.Fprintln(w, errorf("invalid request, expected GET got %s", r.Method))
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	if !allow(w, r, permRead) {
 		return
 	}
 
@@ -528,135 +779,409 @@ func handleSha256sum(w http.ResponseWriter, r *http.Request) {
 		values, err := url.ParseQuery(r.URL.RawQuery)
 		if err != nil {
 			log.Println("handleSha256sum", "url.ParseQuery", err)
-			fmt.Fprintln(w, errorf(err.Error()))
+			fail(w, errorf(http.StatusBadRequest, "%v", err))
 			return
 		}
 
 		id := values.Get("id")
 		if id == "" {
-			fmt.Fprintln(w, errorf("missing id query parameter or path"))
+			fail(w, errorf(http.StatusBadRequest, "missing id query parameter or path"))
 			return
 		}
 
 		r, err := ccID.Get([]byte(id))
 		if err != nil {
-			log.Println("handleSha256sum", "url.ParseQuery", err)
-			fmt.Fprintln(w, errorf(err.Error()))
+			log.Println("handleSha256sum", "ccID.Get", err)
+			fail(w, err)
 			return
 		} else if r == nil {
-			fmt.Fprintln(w, errorf("no path with id %s", id))
+			fail(w, errorf(http.StatusNotFound, "no path with id %s", id))
 			return
 		}
 		path = string(r)
 	} else {
-		path = strings.TrimPrefix(path, "/")
+		p, err := sanitize(strings.TrimPrefix(path, "/"))
+		if err != nil {
+			fail(w, err)
+			return
+		}
+		path = p
+	}
+
+	if !allow(w, r, permRead, path) {
+		return
 	}
 
 	c, err := ccHash.Get([]byte(path))
 	if err != nil {
-		fmt.Fprintln(w, errorf(err.Error()))
+		log.Println("handleSha256sum", "ccHash.Get", err)
+		fail(w, err)
+		return
+	} else if c == nil {
+		fail(w, errorf(http.StatusNotFound, "no checksum for %s", path))
 		return
 	}
 
-	b, err := json.Marshal(ChecksumResponse{
+	reply(w, http.StatusOK, ChecksumResponse{
 		Base:   Base{OK: true},
 		Sha256: string(c),
 		File:   path,
 	})
+}
+
+// ndjsonType is the media type of newline delimited json.
+const ndjsonType = "application/x-ndjson"
+
+// isNDJSON reports whether the request asks for or sends newline delimited
+// json, either with the format query parameter or with the headers.
+func isNDJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "ndjson" {
+		return true
+	}
+	for _, h := range []string{"Accept", "Content-Type"} {
+		if mt, _, _ := mime.ParseMediaType(r.Header.Get(h)); mt == ndjsonType {
+			return true
+		}
+	}
+	return false
+}
+
+// metaPage returns at most limit files the principal can read in order of ID
+// starting after the ID in the cursor, along with the cursor of the next page
+// which is empty if it's the last one.
+// The IDs are walked in order from the cursor and the walk stops as soon as
+// the page is full, so the paths of the IDs before the cursor aren't read.
+func metaPage(p principal, cursor string, limit int) ([]File, []FileError, string, error) {
+	var (
+		page  []File
+		files = []File{}
+		errs  []FileError
+		next  string
+	)
+
+	// The first ID after the cursor is the one followed by a zero byte.
+	err := ccID.Seek([]byte(cursor+"\x00"), func(id, path []byte) error {
+		if !p.can(permRead, string(path)) {
+			return nil
+		}
+		// One more file tells whether there's a next page.
+		if page = append(page, File{ID: string(id), Path: string(path)}); len(page) > limit {
+			return ErrIterationDone
+		}
+		return nil
+	})
 	if err != nil {
-		log.Println("handleSha256sum", "json.Marshal", err)
-		fmt.Fprintln(w, errorf(err.Error()))
-		return
+		return nil, nil, "", fmt.Errorf("metaPage ccID.Seek: %w", err)
+	}
+
+	if len(page) > limit {
+		page = page[:limit]
+		next = base64.RawURLEncoding.EncodeToString([]byte(page[limit-1].ID))
+	}
+
+	for _, f := range page {
+		file, err := describe(f.ID, f.Path)
+		if err != nil {
+			log.Println("metaPage", "describe", err)
+			errs = append(errs, fileError(f.Path, err))
+			continue
+		}
+		files = append(files, file)
 	}
-	fmt.Fprintln(w, string(b))
+	return files, errs, next, nil
+}
+
+// streamMeta writes to w the files the principal can read as newline
+// delimited json while going through ccID.
+// Since the status is sent along with the first file, the files whose
+// metadata can't be read are only logged.
+func streamMeta(w http.ResponseWriter, p principal) error {
+	var (
+		enc     = json.NewEncoder(w)
+		n       int
+		flusher = func() {}
+	)
+
+	if f, ok := w.(http.Flusher); ok {
+		flusher = f.Flush
+	}
+	w.Header().Set("Content-Type", ndjsonType)
+
+	err := ccID.Fold(func(id, path []byte) error {
+		if !p.can(permRead, string(path)) {
+			return nil
+		}
+
+		f, err := describe(string(id), string(path))
+		if err != nil {
+			log.Println("streamMeta", "describe", err)
+			return nil
+		}
+		if err := enc.Encode(f); err != nil {
+			return err
+		}
+		if n++; n%100 == 0 {
+			flusher()
+		}
+		return nil
+	})
+	flusher()
+	return err
 }
 
 func handleGetMeta(w http.ResponseWriter, r *http.Request) {
 	var (
 		files []File
-		errs  []error
+		errs  []FileError
 	)
 
-	if r.Method != http.MethodGet {
-		fmt.Fprintln(w, errorf("invalid request, expected GET got %s", r.Method))
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	if !allow(w, r, permRead) {
+		return
+	}
+
+	// The files the client isn't allowed to read are left out.
+	p, err := authenticate(r)
+	if err != nil {
+		fail(w, err)
 		return
 	}
 
-	err := ccID.Fold(func(id, path []byte) error {
-		h, err := ccHash.Get(path)
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		fail(w, errorf(http.StatusBadRequest, "%v", err))
+		return
+	}
+
+	if isNDJSON(r) {
+		if values.Get("limit") != "" || values.Get("cursor") != "" {
+			fail(w, errorf(http.StatusBadRequest, "the ndjson format isn't paginated"))
+			return
+		}
+		if err := streamMeta(w, p); err != nil {
+			log.Println("handleGetMeta", "streamMeta", err)
+		}
+		return
+	}
+
+	// With either a page size or a cursor the files are returned one page at
+	// a time.
+	if l, c := values.Get("limit"), values.Get("cursor"); l != "" || c != "" {
+		var limit = defaultQueryLimit
+
+		if l != "" {
+			if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > maxQueryLimit {
+				fail(w, errorf(http.StatusBadRequest, "invalid limit %q", l))
+				return
+			}
+		}
+		cursor, err := base64.RawURLEncoding.DecodeString(c)
 		if err != nil {
-			log.Println("handleGetMeta", "ccHash.Get", err)
-			errs = append(errs, err)
-			return nil
+			fail(w, errorf(http.StatusBadRequest, "invalid cursor %q", c))
+			return
 		}
 
-		files = append(files, File{
-			ID:        string(id),
-			Path:      string(path),
-			Sha256sum: string(h),
+		files, errs, next, err := metaPage(p, string(cursor), limit)
+		if err != nil {
+			log.Println("handleGetMeta", err)
+			fail(w, err)
+			return
+		}
+		reply(w, http.StatusOK, MetaResponse{
+			Base:   Base{OK: len(errs) == 0},
+			Files:  files,
+			Errors: errs,
+			Cursor: next,
 		})
+		return
+	}
+
+	err = ccID.Fold(func(id, path []byte) error {
+		if !p.can(permRead, string(path)) {
+			return nil
+		}
+
+		f, err := describe(string(id), string(path))
+		if err != nil {
+			log.Println("handleGetMeta", "describe", err)
+			errs = append(errs, fileError(string(path), err))
+			return nil
+		}
+		files = append(files, f)
 		return nil
 	})
 	if err != nil {
 		log.Println("handleGetMeta", "ccID.Fold", err)
-		fmt.Fprintln(w, errorf(err.Error()))
+		fail(w, err)
 		return
 	}
 
-	b, err := json.Marshal(PutResponse{
+	reply(w, http.StatusOK, PutResponse{
 		Base:   Base{OK: len(errs) == 0},
 		Files:  files,
 		Errors: errs,
 	})
-	if err != nil {
-		log.Println("handleGetMeta", "json.Marshal", err)
-		fmt.Fprintln(w, errorf(err.Error()))
+}
+
+func handleSetMeta(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	if !allow(w, r, permMetaAdmin) {
 		return
 	}
 
-	fmt.Fprintln(w, string(b))
-}
+	var errs []FileError
+
+	// The files in newline delimited json are restored one at a time as
+	// they're read.
+	if isNDJSON(r) {
+		dec := json.NewDecoder(r.Body)
+		for {
+			var f File
+
+			if err := dec.Decode(&f); err == io.EOF {
+				break
+			} else if err != nil {
+				log.Println("handleSetMeta", "json.Decoder.Decode", err)
+				errs = append(errs, fileError("", errorf(http.StatusBadRequest, "%v", err)))
+				break
+			}
 
-func handleSetMeta(w http.ResponseWriter, r *http.Request) {
-	var files []File
+			if err := authorize(r, permMetaAdmin, f.Path); err != nil {
+				errs = append(errs, fileError(f.Path, err))
+			} else {
+				errs = append(errs, restore([]File{f})...)
+			}
+		}
 
-	if r.Method != http.MethodPost {
-		fmt.Fprintln(w, errorf("invalid request, expected POST got %s", r.Method))
+		reply(w, http.StatusOK, PutResponse{
+			Base:   Base{OK: len(errs) == 0},
+			Errors: errs,
+		})
 		return
 	}
 
+	var files []File
+
 	err := json.NewDecoder(r.Body).Decode(&files)
 	if err != nil {
 		log.Println("handleSetMeta", "json.Decoder.Decode", err)
-		fmt.Fprintln(w, errorf(err.Error()))
+		fail(w, errorf(http.StatusBadRequest, "%v", err))
 		return
 	}
 
-	errs := restore(files)
-	b, err := json.Marshal(PutResponse{
+	var allowed []File
+	for _, f := range files {
+		if err := authorize(r, permMetaAdmin, f.Path); err != nil {
+			errs = append(errs, fileError(f.Path, err))
+		} else {
+			allowed = append(allowed, f)
+		}
+	}
+
+	errs = append(errs, restore(allowed)...)
+	reply(w, http.StatusOK, PutResponse{
 		Base:   Base{OK: len(errs) == 0},
 		Errors: errs,
 	})
+}
+
+// readInputFile reads the next InputFile from the json stream saving its
+// content in a temporary file. The problems with the file are returned as an
+// Error, the other errors are syntax errors.
+func readInputFile(s jsonStream) (f InputFile, u upload, err error) {
+	var (
+		content bool
+		// The first problem with the file, the rest of the object is read
+		// anyway so that the following files can be read.
+		invalid error
+	)
+
+	err = s.object(func(key string) (err error) {
+		switch key {
+		case "id":
+			f.ID, err = s.readString()
+			return
+
+		case "path":
+			f.Path, err = s.readString()
+			return
+
+		case "attrs", "tags":
+			raw, err := s.rawValue()
+			if err != nil {
+				return err
+			}
+			if f.Meta == nil {
+				f.Meta = &Meta{}
+			}
+			if key == "attrs" {
+				err = json.Unmarshal(raw, &f.Meta.Attrs)
+			} else {
+				err = json.Unmarshal(raw, &f.Meta.Tags)
+			}
+			if err != nil && invalid == nil {
+				invalid = errorf(http.StatusBadRequest, "invalid %s for file %q: %v", key, f.Path, err)
+			}
+			return nil
+
+		case "content":
+			sr, err := s.stringReader()
+			if err != nil {
+				return err
+			}
+
+			os.Remove(u.tmp)
+			u, err = receive(base64.NewDecoder(base64.StdEncoding, sr))
+			// Discard what's left of the string in case of decoding errors.
+			if _, e := io.Copy(io.Discard, sr); e != nil {
+				return e
+			}
+			var corrupt base64.CorruptInputError
+			switch {
+			case err == nil:
+				content = sr.n > 0
+			case invalid != nil:
+				// Only the first problem is reported.
+			case errors.As(err, &corrupt):
+				invalid = errorf(http.StatusBadRequest, "invalid content for file %q: %v", f.Path, err)
+			default:
+				invalid = asError(err)
+			}
+			return nil
+
+		default:
+			_, err := s.rawValue()
+			return err
+		}
+	})
 	if err != nil {
-		log.Println("handleSetMeta", "json.Marshal", err)
-		fmt.Fprintln(w, errorf(err.Error()))
-		return
+		// Syntax errors can't be recovered from.
+		os.Remove(u.tmp)
+		return f, upload{}, err
+	}
+	if invalid != nil {
+		os.Remove(u.tmp)
+		return f, upload{}, invalid
 	}
 
-	fmt.Fprintln(w, string(b))
+	if f.ID == "" || f.Path == "" || !content {
+		os.Remove(u.tmp)
+		return f, upload{}, errMissingData
+	}
+	return f, u, nil
 }
 
-func handlePutWithMeta(w http.ResponseWriter, r *http.Request) {
-	var files []InputFile
+var errMissingData = errors.New("missing data")
 
-	if r.Method != http.MethodPost {
-		fmt.Fprintln(w, errorf("invalid request, expected POST got %s", r.Method))
+func handlePutWithMeta(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
 		return
 	}
-
-	if err := json.NewDecoder(r.Body).Decode(&files); err != nil {
-		log.Println("handlePutWithMeta", "json.Decoder.Decode", err)
-		fmt.Fprintln(w, errorf(err.Error()))
+	if !allow(w, r, permWrite|permMetaAdmin) {
 		return
 	}
 
@@ -664,51 +1189,68 @@ func handlePutWithMeta(w http.ResponseWriter, r *http.Request) {
 		wg         sync.WaitGroup
 		savedFiles FileList
 		errs       ErrList
-		ok         = true
+		i          int
+		stream     = newJSONStream(r.Body)
 	)
 
-	for i, f := range files {
-		wg.Add(1)
-		go func(i int, f InputFile) {
-			defer wg.Done()
+	// The files are decoded from the json stream one at a time and their
+	// content is streamed straight to disk.
+	err := stream.array(func() error {
+		defer func() { i++ }()
 
-			if f.ID == "" || f.Path == "" || f.Content == "" {
-				ok = false
-				err := fmt.Errorf("missing data for file #%d", i)
-				log.Println("handlePutWithMeta", err)
-				errs.Append(err)
-				return
-			}
+		f, u, err := readInputFile(stream)
+		if errors.Is(err, errMissingData) {
+			err = errorf(http.StatusBadRequest, "missing data for file #%d", i)
+		}
+		// The invalid files are reported one by one, only the syntax errors
+		// abort the whole array.
+		var invalid Error
+		if errors.As(err, &invalid) {
+			log.Println("handlePutWithMeta", err)
+			errs.Append(fileError(f.Path, err))
+			return nil
+		} else if err != nil {
+			return err
+		}
 
-			cnt, err := base64.StdEncoding.DecodeString(f.Content)
-			if err != nil {
-				ok = false
-				log.Println("handlePutWithMeta", "base64.StdEncoding.DecodeString", err)
-				errs.Append(err)
-				return
-			}
+		if err := authorize(r, permWrite|permMetaAdmin, f.Path); err != nil {
+			os.Remove(u.tmp)
+			errs.Append(fileError(f.Path, err))
+			return nil
+		}
+		if err := f.Meta.normalize(); err != nil {
+			os.Remove(u.tmp)
+			errs.Append(fileError(f.Path, err))
+			return nil
+		}
+		u.uploader = uploader(r)
+		u.meta = f.Meta
+
+		wg.Add(1)
+		go func(f InputFile, u upload) {
+			defer wg.Done()
 
-			if file, err := saveData(f.ID, f.Path, cnt); err == nil {
+			if file, err := saveData(f.ID, f.Path, u); err == nil {
 				savedFiles.Append(file)
 			} else {
-				ok = false
-				log.Println("handlePutWithMeta", "putWithID", err)
+				log.Println("handlePutWithMeta", "saveData", err)
+				errs.Append(fileError(f.Path, err))
 			}
-		}(i, f)
-	}
+		}(f, u)
+		return nil
+	})
 	wg.Wait()
 
-	b, err := json.Marshal(PutResponse{
-		Base:   Base{OK: ok},
+	if err != nil {
+		log.Println("handlePutWithMeta", "jsonStream.array", err)
+		errs.Append(fileError("", errorf(http.StatusBadRequest, "%v", err)))
+	}
+
+	reply(w, putStatus(savedFiles.Slice(), errs.Slice()), PutResponse{
+		Base:   Base{OK: len(errs.Slice()) == 0},
 		Files:  savedFiles.Slice(),
 		Errors: errs.Slice(),
 	})
-	if err != nil {
-		log.Println("handlePutWithMeta", "json.Marshal", err)
-		fmt.Fprintln(w, errorf(err.Error()))
-		return
-	}
-	fmt.Fprintln(w, string(b))
 }
 
 func createIfNotExists(path string) {
@@ -731,6 +1273,7 @@ func config() Config {
 	flag.StringVar(&cfg.CertPath, "cert", cfg.CertPath, "The path to the certificate.")
 	flag.StringVar(&cfg.ServerKey, "key", cfg.ServerKey, "The path to the file containing the private keys that match with the certificate.")
 	flag.BoolVar(&cfg.EnableTLS, "tls", cfg.EnableTLS, "Enable HTTPS connections.")
+	flag.IntVar(&cfg.ScrubRate, "scrub", cfg.ScrubRate, "The number of files per minute whose checksum is verified in background, 0 disables it.")
 	flag.Parse()
 
 	if !strings.HasPrefix(cfg.Port, ":") {
@@ -746,10 +1289,102 @@ func config() Config {
 	return cfg
 }
 
-// tick executes fn every day at midnight and logs its error if any.
-func tick(c <-chan time.Time, fn func() error) {
-	for t := range c {
-		if t.Hour() == 0 && t.Minute() == 0 {
+// tick executes fn every day at midnight and logs its error if any, until
+// stop is closed.
+func tick(stop <-chan struct{}, c <-chan time.Time, fn func() error) {
+	for {
+		select {
+		case <-stop:
+			return
+		case t := <-c:
+			if t.Hour() == 0 && t.Minute() == 0 {
+				if err := fn(); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	}
+}
+
+// openCaches opens all the caches used by Adam, they stay open until
+// closeCaches is called.
+func openCaches() (err error) {
+	// The path index didn't exist in older versions of Adam, in that case
+	// we build it from the other caches.
+	indexed, err := exists(filepath.Join(cfg.CacheDir, "paths"))
+	if err != nil {
+		return fmt.Errorf("openCaches exists: %w", err)
+	}
+
+	for _, c := range []struct {
+		cc   **Cache
+		name string
+	}{
+		{&ccHash, "sha256sum"},
+		{&ccID, "ids"},
+		{&ccPath, "paths"},
+		{&ccScrub, "scrub"},
+		{&ccKeys, "keys"},
+		{&ccBlobs, "blobs"},
+		{&ccVersions, "versions"},
+		{&ccTrash, "trash"},
+		{&ccStat, "stat"},
+		{&ccMeta, "meta"},
+		{&ccQuery, "query"},
+		{&ccChanges, "changes"},
+	} {
+		if *c.cc, err = OpenCache(filepath.Join(cfg.CacheDir, c.name)); err != nil {
+			return fmt.Errorf("openCaches %s: %w", c.name, err)
+		}
+		register(c.name, *c.cc)
+	}
+
+	if !indexed {
+		if err := rebuildPathIndex(); err != nil {
+			return err
+		}
+	}
+	if err := checkQueryIndex(); err != nil {
+		return err
+	}
+	return replayJournal()
+}
+
+// closeCaches closes all the caches opened with openCaches.
+func closeCaches() {
+	for name, c := range stores {
+		if err := c.Close(); err != nil {
+			log.Println("closeCaches", name, err)
+		}
+	}
+}
+
+// shutdownOnSignal gracefully shuts the server down when the process
+// receives either SIGINT or SIGTERM and closes done once all the pending
+// requests have been served.
+func shutdownOnSignal(srv *http.Server, done chan struct{}) {
+	defer close(done)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+
+	log.Println("shutting down...")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("shutdownOnSignal", "srv.Shutdown", err)
+	}
+}
+
+// schedule executes fn at each tick and logs its error if any, until stop is
+// closed.
+func schedule(stop <-chan struct{}, c <-chan time.Time, fn func() error) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-c:
 			if err := fn(); err != nil {
 				log.Println(err)
 			}
@@ -760,6 +1395,43 @@ func tick(c <-chan time.Time, fn func() error) {
 func main() {
 	cfg = config()
 
+	createIfNotExists(cfg.BaseDir)
+	createIfNotExists(cfg.CacheDir)
+	if err := checkInternalDir(); err != nil {
+		log.Fatal(err)
+	}
+
+	if flag.Arg(0) == "gencert" {
+		os.Exit(runGencert(flag.Args()[1:]))
+	}
+
+	if err := openCaches(); err != nil {
+		log.Fatal(err)
+	}
+	defer closeCaches()
+
+	if err := loadKeys(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadACL(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadClientAuth(); err != nil {
+		log.Fatal(err)
+	}
+
+	if flag.Arg(0) == "fsck" {
+		status := runFsck(flag.Args()[1:])
+		closeCaches()
+		os.Exit(status)
+	}
+
+	if flag.Arg(0) == "snapshot" {
+		status := runSnapshot(flag.Args()[1:])
+		closeCaches()
+		os.Exit(status)
+	}
+
 	if cfg.backupFile != "" {
 		if errs := restoreFile(cfg.backupFile); len(errs) != 0 {
 			for _, e := range errs {
@@ -771,18 +1443,47 @@ func main() {
 		return
 	}
 
-	go createIfNotExists(cfg.BaseDir)
-	go createIfNotExists(cfg.CacheDir)
+	cleanTemp()
+	if err := loadUploads(); err != nil {
+		log.Println(err)
+	}
+
+	// The periodic jobs use the caches, so they're stopped and waited for
+	// before closing them.
+	var (
+		jobs sync.WaitGroup
+		stop = make(chan struct{})
+	)
+	run := func(loop func(<-chan struct{}, <-chan time.Time, func() error), d time.Duration, fn func() error) {
+		t := time.NewTicker(d)
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			defer t.Stop()
+			loop(stop, t.C, fn)
+		}()
+	}
+	stopJobs := func() {
+		close(stop)
+		jobs.Wait()
+	}
 
-	ccHash = Cache(filepath.Join(cfg.CacheDir, "sha256sum"))
-	go tick(time.Tick(time.Minute), ccHash.Merge)
+	run(schedule, time.Hour, expireUploads)
 
-	ccID = Cache(filepath.Join(cfg.CacheDir, "ids"))
-	go tick(time.Tick(time.Minute), ccID.Merge)
+	for _, c := range stores {
+		run(tick, time.Minute, c.Merge)
+	}
+	run(tick, time.Minute, expireTrash)
 
-	log.Printf("Adam is running on port %s...\n", cfg.Port)
+	if cfg.ScrubRate > 0 {
+		s := &scrubber{
+			rate:   cfg.ScrubRate,
+			period: time.Duration(cfg.ScrubPeriod) * time.Hour,
+		}
+		run(schedule, time.Minute, s.step)
+	}
 
-	http.Handle("/", http.StripPrefix("/", http.FileServer(http.Dir(cfg.BaseDir))))
+	http.Handle("/", http.StripPrefix("/", browse(http.FileServer(http.Dir(cfg.BaseDir)))))
 	http.HandleFunc("/get", handleGet)
 	http.HandleFunc("/put", handlePut)
 	http.HandleFunc("/put/", handlePut)
@@ -794,10 +1495,62 @@ func main() {
 	http.HandleFunc("/get_meta", handleGetMeta)
 	http.HandleFunc("/set_meta", handleSetMeta)
 	http.HandleFunc("/put_with_meta", handlePutWithMeta)
+	http.HandleFunc("/scrub_report", handleScrubReport)
+	http.HandleFunc("/tus", handleTus)
+	http.HandleFunc(tusPrefix, handleTus)
+	http.HandleFunc(v1Prefix, handleV1)
+	http.HandleFunc("/keys", handleKeys)
+	http.HandleFunc("/keys/", handleKeys)
+	http.HandleFunc("/presign", handlePresign)
+	http.HandleFunc("/versions", handleVersions)
+	http.HandleFunc("/rollback", handleRollback)
+	http.HandleFunc("/trash", handleTrash)
+	http.HandleFunc("/trash/restore", handleTrashRestore)
+	http.HandleFunc("/trash/purge", handleTrashPurge)
+	http.HandleFunc("/snapshots", handleSnapshots)
+	http.HandleFunc("/snapshots/", handleSnapshots)
+	http.HandleFunc("/stat", handleStat)
+	http.HandleFunc("/stat/", handleStat)
+	http.HandleFunc("/meta", handleMeta)
+	http.HandleFunc("/query", handleQuery)
+	http.HandleFunc("/changes", handleChanges)
+
+	if cfg.EnableTLS {
+		if err := ensureCert(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	tlsCfg, err := tlsConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var handler http.Handler = http.DefaultServeMux
+	if cfg.AccessLog {
+		handler = accessLog(handler)
+	}
+
+	srv := &http.Server{
+		Addr:      cfg.Port,
+		Handler:   handler,
+		TLSConfig: tlsCfg,
+	}
+	done := make(chan struct{})
+	go shutdownOnSignal(srv, done)
+
+	log.Printf("Adam is running on port %s...\n", cfg.Port)
 
 	if cfg.EnableTLS {
-		log.Fatal(http.ListenAndServeTLS(cfg.Port, cfg.CertPath, cfg.ServerKey, nil))
+		err = srv.ListenAndServeTLS(cfg.CertPath, cfg.ServerKey)
 	} else {
-		log.Fatal(http.ListenAndServe(cfg.Port, nil))
+		err = srv.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		stopJobs()
+		closeCaches()
+		log.Fatal(err)
 	}
+	<-done
+	stopJobs()
 }
@@ -0,0 +1,289 @@
+/*
+ * Adam - Adam's a Data Access Manager
+ * Copyright (C) 2021 Nicolò Santamaria
+ *
+ * Adam is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Adam is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// The clients can attach to each file free form attributes and tags, kept
+// under the ID of the file so that they follow it when it's moved or
+// overwritten.
+
+// ccMeta maps the ID of each file to its Meta.
+var ccMeta *Cache
+
+// maxMetaSize is the maximum size of the json of a Meta sent by the clients.
+const maxMetaSize = 64 << 10
+
+// empty reports whether m has neither attributes nor tags.
+func (m *Meta) empty() bool {
+	return m == nil || (len(m.Attrs) == 0 && len(m.Tags) == 0)
+}
+
+// normalize checks the attributes and the tags of m and sorts the tags
+// dropping the duplicates.
+func (m *Meta) normalize() error {
+	if m == nil {
+		return nil
+	}
+
+	// The NUL byte separates the parts of the keys of the query index.
+	for k := range m.Attrs {
+		if k == "" {
+			return errorf(http.StatusBadRequest, "empty attribute name")
+		} else if strings.ContainsRune(k, 0) {
+			return errorf(http.StatusBadRequest, "invalid attribute name %q", k)
+		}
+	}
+	if len(m.Attrs) == 0 {
+		m.Attrs = nil
+	}
+
+	var (
+		tags = m.Tags
+		seen = make(map[string]bool)
+	)
+	m.Tags = nil
+	for _, t := range tags {
+		if t == "" {
+			return errorf(http.StatusBadRequest, "empty tag")
+		} else if strings.ContainsRune(t, 0) {
+			return errorf(http.StatusBadRequest, "invalid tag %q", t)
+		}
+		if !seen[t] {
+			seen[t] = true
+			m.Tags = append(m.Tags, t)
+		}
+	}
+	sort.Strings(m.Tags)
+	return nil
+}
+
+// apply returns a copy of m with the changes in the patch applied.
+func (m *Meta) apply(p MetaPatch) *Meta {
+	var res = &Meta{Attrs: make(map[string]string)}
+
+	if m != nil {
+		for k, v := range m.Attrs {
+			res.Attrs[k] = v
+		}
+		res.Tags = append(res.Tags, m.Tags...)
+	}
+
+	for k, v := range p.Attrs {
+		if v == nil {
+			delete(res.Attrs, k)
+		} else {
+			res.Attrs[k] = *v
+		}
+	}
+
+	var remove = make(map[string]bool)
+	for _, t := range p.RemoveTags {
+		remove[t] = true
+	}
+	tags := append(res.Tags, p.AddTags...)
+	res.Tags = nil
+	for _, t := range tags {
+		if !remove[t] {
+			res.Tags = append(res.Tags, t)
+		}
+	}
+	return res
+}
+
+// decodeMeta reads the json of a Meta from r and normalizes it.
+func decodeMeta(r io.Reader) (*Meta, error) {
+	var m Meta
+
+	if err := json.NewDecoder(io.LimitReader(r, maxMetaSize)).Decode(&m); err != nil {
+		return nil, errorf(http.StatusBadRequest, "invalid metadata: %v", err)
+	}
+	if err := m.normalize(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// fileMeta returns the Meta of the file with the given ID or nil if it has
+// none.
+func fileMeta(id string) (*Meta, error) {
+	b, err := ccMeta.Get([]byte(id))
+	if err != nil || b == nil {
+		return nil, err
+	}
+
+	var m Meta
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// setMeta replaces the Meta of the file with the given ID with the result of
+// fn, which is called with the current one, and returns the updated file.
+func setMeta(id string, fn func(*Meta) *Meta) (File, error) {
+	var file File
+
+	err := update(func(tx *Txn) error {
+		path, err := tx.Get(ccID, []byte(id))
+		if err != nil {
+			return err
+		} else if path == nil {
+			return errorf(http.StatusNotFound, "no path with id %s", id)
+		}
+
+		if file, err = describe(id, string(path)); err != nil {
+			return err
+		}
+		if err := unindexQuery(tx, id, file.Path); err != nil {
+			return err
+		}
+		file.Meta = fn(file.Meta)
+		if err := file.Meta.normalize(); err != nil {
+			return err
+		}
+
+		if file.Meta.empty() {
+			file.Meta = nil
+			tx.Del(ccMeta, []byte(id))
+		} else {
+			b, err := json.Marshal(file.Meta)
+			if err != nil {
+				return err
+			}
+			tx.Put(ccMeta, []byte(id), b)
+		}
+		if err := indexQuery(tx, id, file.Path); err != nil {
+			return err
+		}
+		return logChange(tx, Change{Op: changeMeta, ID: id, Path: file.Path, Sha256sum: file.Sha256sum})
+	})
+	if err != nil {
+		return File{}, fmt.Errorf("setMeta update: %w", err)
+	}
+	return file, nil
+}
+
+func handleMeta(w http.ResponseWriter, r *http.Request) {
+	allowed := []string{
+		http.MethodGet,
+		http.MethodPut,
+		http.MethodPatch,
+		http.MethodDelete,
+	}
+	if !checkMethod(w, r, allowed...) {
+		return
+	}
+
+	var perm = permWrite
+	if r.Method == http.MethodGet {
+		perm = permRead
+	}
+	if !allow(w, r, perm) {
+		return
+	}
+
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		fail(w, errorf(http.StatusBadRequest, "%v", err))
+		return
+	}
+
+	id := values.Get("id")
+	if id == "" {
+		fail(w, errorf(http.StatusBadRequest, "missing id query parameter"))
+		return
+	}
+
+	path, err := ccID.Get([]byte(id))
+	if err != nil {
+		log.Println("handleMeta", "ccID.Get", err)
+		fail(w, err)
+		return
+	} else if path == nil {
+		fail(w, errorf(http.StatusNotFound, "no path with id %s", id))
+		return
+	}
+	if !allow(w, r, perm, string(path)) {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		file, err := describe(id, string(path))
+		if err != nil {
+			log.Println("handleMeta", "describe", err)
+			fail(w, err)
+			return
+		}
+		reply(w, http.StatusOK, FileResponse{
+			Base: Base{OK: true},
+			File: &file,
+		})
+		return
+	}
+
+	var file File
+
+	switch r.Method {
+	case http.MethodPut:
+		m, e := decodeMeta(r.Body)
+		if e != nil {
+			fail(w, e)
+			return
+		}
+		file, err = setMeta(id, func(*Meta) *Meta {
+			return m
+		})
+
+	case http.MethodPatch:
+		var p MetaPatch
+		if e := json.NewDecoder(io.LimitReader(r.Body, maxMetaSize)).Decode(&p); e != nil {
+			fail(w, errorf(http.StatusBadRequest, "invalid metadata patch: %v", e))
+			return
+		}
+		file, err = setMeta(id, func(m *Meta) *Meta {
+			return m.apply(p)
+		})
+
+	case http.MethodDelete:
+		file, err = setMeta(id, func(*Meta) *Meta {
+			return nil
+		})
+	}
+	if err != nil {
+		log.Println("handleMeta", err)
+		fail(w, errors.Unwrap(err))
+		return
+	}
+
+	reply(w, http.StatusOK, FileResponse{
+		Base: Base{OK: true},
+		File: &file,
+	})
+}
@@ -0,0 +1,134 @@
+/*
+ * Adam - Adam's a Data Access Manager
+ * Copyright (C) 2021 Nicolò Santamaria
+ *
+ * Adam is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Adam is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// Verification modes of the client certificates.
+const (
+	// clientAuthRequire rejects the clients without a valid certificate.
+	clientAuthRequire = "require"
+	// clientAuthVerify verifies the certificates of the clients sending one.
+	clientAuthVerify = "verify"
+	// clientAuthNone ignores the client certificates.
+	clientAuthNone = "none"
+)
+
+// Mappings of the client certificates subject to principals.
+const (
+	subjectNone = "none"
+	subjectCN   = "cn"
+	subjectDN   = "dn"
+)
+
+// clientPerm contains the permissions of the principals authenticated with
+// a client certificate.
+var clientPerm Perm
+
+// loadClientAuth validates the configuration of the client certificates.
+func loadClientAuth() (err error) {
+	switch cfg.ClientAuth {
+	case clientAuthRequire, clientAuthVerify, clientAuthNone:
+	default:
+		return fmt.Errorf("loadClientAuth: invalid client_auth %q", cfg.ClientAuth)
+	}
+
+	switch cfg.ClientPrincipal {
+	case subjectNone, subjectCN, subjectDN:
+	default:
+		return fmt.Errorf("loadClientAuth: invalid client_principal %q", cfg.ClientPrincipal)
+	}
+
+	if cfg.ClientCA != "" && !cfg.EnableTLS {
+		return errors.New("loadClientAuth: client_ca requires TLS to be enabled")
+	}
+
+	if clientPerm, err = parsePerm(cfg.ClientPermissions); err != nil {
+		return fmt.Errorf("loadClientAuth: %w", err)
+	}
+	return nil
+}
+
+// tlsConfig returns the TLS configuration verifying the client certificates
+// with the CA bundle in the configuration, or nil if there's none.
+func tlsConfig() (*tls.Config, error) {
+	if cfg.ClientCA == "" || cfg.ClientAuth == clientAuthNone {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(cfg.ClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("tlsConfig: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("tlsConfig: no certificates found in %s", cfg.ClientCA)
+	}
+
+	mode := tls.RequireAndVerifyClientCert
+	if cfg.ClientAuth == clientAuthVerify {
+		mode = tls.VerifyClientCertIfGiven
+	}
+
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: mode,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+// clientSubject returns the subject of the verified client certificate of
+// the request, if any.
+func clientSubject(r *http.Request) (pkix.Name, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return pkix.Name{}, false
+	}
+	return r.TLS.VerifiedChains[0][0].Subject, true
+}
+
+// clientPrincipal returns the principal the client certificate of the request
+// is mapped to, if any.
+func clientPrincipal(r *http.Request) (principal, bool) {
+	if cfg.ClientPrincipal == subjectNone {
+		return principal{}, false
+	}
+
+	s, ok := clientSubject(r)
+	if !ok {
+		return principal{}, false
+	}
+
+	name := s.CommonName
+	if cfg.ClientPrincipal == subjectDN {
+		name = s.String()
+	}
+	if name == "" {
+		return principal{}, false
+	}
+	return principal{name: name, perm: clientPerm}, true
+}
@@ -0,0 +1,173 @@
+/*
+ * Adam - Adam's a Data Access Manager
+ * Copyright (C) 2021 Nicolò Santamaria
+ *
+ * Adam is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Adam is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Policies about the symbolic links found in the paths requested by clients.
+const (
+	// symlinksInside allows the symbolic links pointing inside the base dir.
+	symlinksInside = "inside"
+	// symlinksDeny rejects every path containing a symbolic link.
+	symlinksDeny = "deny"
+	// symlinksFollow allows every symbolic link, wherever it points.
+	symlinksFollow = "follow"
+)
+
+// sanitize validates a path provided by a client and returns it cleaned and
+// relative to the base directory. The paths that are absolute, contain NUL
+// bytes, escape the base directory or point to the base directory itself or
+// to Adam's internal directory are rejected.
+func sanitize(path string) (string, error) {
+	return sanitizeIn(cfg.BaseDir, path)
+}
+
+// sanitizeIn is like sanitize but the path is relative to root.
+func sanitizeIn(root, path string) (string, error) {
+	if strings.ContainsRune(path, 0) {
+		return "", errorf(http.StatusBadRequest, "invalid path %q: NUL byte", path)
+	}
+
+	if isAbs(path) {
+		return "", errorf(http.StatusBadRequest, "invalid path %q: absolute path", path)
+	}
+
+	clean := filepath.Clean(path)
+	switch {
+	case clean == ".":
+		return "", errorf(http.StatusBadRequest, "invalid path %q: empty path", path)
+
+	case clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)):
+		return "", errorf(http.StatusBadRequest, "invalid path %q: outside of the base directory", path)
+
+	case inTree(clean, internalDir):
+		return "", errorf(http.StatusForbidden, "invalid path %q: reserved path", path)
+	}
+
+	if err := checkSymlinks(root, clean); err != nil {
+		return "", err
+	}
+	return clean, nil
+}
+
+// checkName validates the name of a file uploaded in a multipart form, which
+// must be a single path element.
+func checkName(name string) error {
+	switch {
+	case strings.ContainsRune(name, 0):
+		return errorf(http.StatusBadRequest, "invalid file name %q: NUL byte", name)
+
+	case name == "" || name == "." || name == "..":
+		return errorf(http.StatusBadRequest, "invalid file name %q", name)
+
+	case strings.ContainsAny(name, `/\`):
+		return errorf(http.StatusBadRequest, "invalid file name %q: path separator", name)
+	}
+	return nil
+}
+
+// checkID validates the ID of a file given by the client.
+func checkID(id string) error {
+	switch {
+	case id == "":
+		return errorf(http.StatusBadRequest, "invalid id %q: empty id", id)
+
+	case strings.ContainsRune(id, 0):
+		return errorf(http.StatusBadRequest, "invalid id %q: NUL byte", id)
+	}
+	return nil
+}
+
+// isAbs reports whether path is absolute on any of the supported systems.
+func isAbs(path string) bool {
+	return filepath.IsAbs(path) ||
+		filepath.VolumeName(path) != "" ||
+		strings.HasPrefix(path, "/") ||
+		strings.HasPrefix(path, `\`)
+}
+
+// checkSymlinks enforces the symlink policy on the existing part of the path
+// relative to root.
+func checkSymlinks(root, path string) error {
+	if cfg.SymlinkPolicy == symlinksFollow {
+		return nil
+	}
+
+	base, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+
+	cur := base
+	for _, name := range strings.Split(path, string(filepath.Separator)) {
+		cur = filepath.Join(cur, name)
+
+		info, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			// The rest of the path doesn't exist yet.
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		if cfg.SymlinkPolicy == symlinksDeny {
+			return errorf(http.StatusForbidden, "invalid path %q: symbolic links are not allowed", path)
+		}
+
+		// Dangling links are rejected as well since writing through them
+		// could create files anywhere.
+		target, err := filepath.EvalSymlinks(cur)
+		if err != nil {
+			return errorf(http.StatusForbidden, "invalid path %q: unresolvable symbolic link", path)
+		}
+
+		rel, err := filepath.Rel(base, target)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return errorf(http.StatusForbidden, "invalid path %q: symbolic link outside of the base directory", path)
+		}
+		cur = target
+	}
+	return nil
+}
+
+// browse serves the directory tree to the clients allowed to read it,
+// rejecting the unsafe paths.
+func browse(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allow(w, r, permRead, r.URL.Path) {
+			return
+		}
+		if r.URL.Path != "" {
+			if _, err := sanitize(r.URL.Path); err != nil {
+				fail(w, err)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,248 @@
+/*
+ * Adam - Adam's a Data Access Manager
+ * Copyright (C) 2021 Nicolò Santamaria
+ *
+ * Adam is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Adam is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Pre-signed URLs grant the access to a single file for download via /get or
+// to a single directory for upload via /put until they expire. They carry
+// their constraints in the query parameters along with an HMAC signature of
+// them made with the secret in the configuration, so that they can be
+// validated without keeping any state.
+
+const (
+	signGet = "get"
+	signPut = "put"
+
+	defaultURLExpiry = time.Hour
+	maxURLExpiry     = 7 * 24 * time.Hour
+)
+
+// signedURL represents the constraints of a pre-signed URL.
+type signedURL struct {
+	op          string
+	target      string
+	expires     int64
+	maxSize     int64
+	contentType string
+}
+
+// signature returns the HMAC signature of the URL constraints.
+func (s signedURL) signature() string {
+	mac := hmac.New(sha256.New, []byte(cfg.URLSecret))
+	mac.Write([]byte(strings.Join([]string{
+		s.op,
+		s.target,
+		strconv.FormatInt(s.expires, 10),
+		strconv.FormatInt(s.maxSize, 10),
+		s.contentType,
+	}, "\n")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// url returns the path and the query of the pre-signed URL.
+func (s signedURL) url() string {
+	var (
+		q = url.Values{}
+		u = url.URL{Path: "/get"}
+	)
+
+	switch s.op {
+	case signGet:
+		q.Set("id", s.target)
+	case signPut:
+		u.Path = "/put"
+		if s.target != "." {
+			u.Path = path.Join(u.Path, s.target)
+		}
+	}
+
+	q.Set("expires", strconv.FormatInt(s.expires, 10))
+	if s.maxSize > 0 {
+		q.Set("max_size", strconv.FormatInt(s.maxSize, 10))
+	}
+	if s.contentType != "" {
+		q.Set("content_type", s.contentType)
+	}
+	q.Set("signature", s.signature())
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// putTarget returns the directory in the form used by the signatures.
+func putTarget(dir string) string {
+	return path.Clean(strings.TrimPrefix(dir, "/"))
+}
+
+// parseSignedURL returns the constraints of the pre-signed URL of the request
+// and whether the request carries a signature at all. An error is returned if
+// the signature is invalid or expired.
+func parseSignedURL(r *http.Request) (s signedURL, signed bool, err error) {
+	q := r.URL.Query()
+
+	sig := q.Get("signature")
+	if sig == "" {
+		return s, false, nil
+	}
+	if cfg.URLSecret == "" {
+		return s, true, errorf(http.StatusUnauthorized, "pre-signed URLs are disabled")
+	}
+
+	switch {
+	case r.URL.Path == "/get":
+		s.op, s.target = signGet, q.Get("id")
+	case r.URL.Path == "/put" || strings.HasPrefix(r.URL.Path, "/put/"):
+		s.op, s.target = signPut, putTarget(strings.TrimPrefix(r.URL.Path, "/put"))
+	default:
+		return s, true, errorf(http.StatusUnauthorized, "pre-signed URLs are not supported by %s", r.URL.Path)
+	}
+
+	if s.expires, err = strconv.ParseInt(q.Get("expires"), 10, 64); err != nil {
+		return s, true, errorf(http.StatusUnauthorized, "invalid expires query parameter")
+	}
+	if m := q.Get("max_size"); m != "" {
+		if s.maxSize, err = strconv.ParseInt(m, 10, 64); err != nil {
+			return s, true, errorf(http.StatusUnauthorized, "invalid max_size query parameter")
+		}
+	}
+	s.contentType = q.Get("content_type")
+
+	if !hmac.Equal([]byte(sig), []byte(s.signature())) {
+		return s, true, errorf(http.StatusUnauthorized, "invalid signature")
+	}
+	if time.Now().Unix() > s.expires {
+		return s, true, errorf(http.StatusUnauthorized, "the URL expired")
+	}
+	return s, true, nil
+}
+
+// checkContentType returns an error if the media type of ctype isn't the one
+// required by the pre-signed URL.
+func (s signedURL) checkContentType(ctype string) error {
+	if s.contentType == "" {
+		return nil
+	}
+
+	mt, _, err := mime.ParseMediaType(ctype)
+	if err != nil || !strings.EqualFold(mt, s.contentType) {
+		return errorf(http.StatusUnsupportedMediaType, "expected content type %s got %q", s.contentType, ctype)
+	}
+	return nil
+}
+
+func handlePresign(w http.ResponseWriter, r *http.Request) {
+	var req PresignRequest
+
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	// The permissions on the file are checked once it's known.
+	if !allow(w, r, 0) {
+		return
+	}
+	if cfg.URLSecret == "" {
+		fail(w, errorf(http.StatusNotFound, "pre-signed URLs are disabled"))
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Println("handlePresign", "json.Decoder.Decode", err)
+		fail(w, errorf(http.StatusBadRequest, "%v", err))
+		return
+	}
+
+	expiry := defaultURLExpiry
+	if req.ExpiresIn > 0 {
+		expiry = time.Duration(req.ExpiresIn) * time.Second
+	}
+	if expiry > maxURLExpiry {
+		fail(w, errorf(http.StatusBadRequest, "expires_in exceeds %d seconds", int64(maxURLExpiry/time.Second)))
+		return
+	}
+
+	var s = signedURL{
+		op:          req.Op,
+		expires:     time.Now().Add(expiry).Unix(),
+		maxSize:     req.MaxSize,
+		contentType: req.ContentType,
+	}
+
+	switch req.Op {
+	case signGet:
+		if req.ID == "" {
+			fail(w, errorf(http.StatusBadRequest, "missing id"))
+			return
+		}
+
+		p, err := ccID.Get([]byte(req.ID))
+		if err != nil {
+			log.Println("handlePresign", "ccID.Get", err)
+			fail(w, err)
+			return
+		} else if p == nil {
+			fail(w, errorf(http.StatusNotFound, "no path with id %s", req.ID))
+			return
+		}
+
+		if !allow(w, r, permRead, string(p)) {
+			return
+		}
+		s.target = req.ID
+
+	case signPut:
+		s.target = putTarget(req.Path)
+		if s.target != "." {
+			if _, err := sanitize(s.target); err != nil {
+				fail(w, err)
+				return
+			}
+		}
+		if !allow(w, r, permWrite, s.target) {
+			return
+		}
+
+	default:
+		fail(w, errorf(http.StatusBadRequest, "invalid op %q, expected %s or %s", req.Op, signGet, signPut))
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	reply(w, http.StatusOK, PresignResponse{
+		Base:    Base{OK: true},
+		URL:     scheme + "://" + r.Host + s.url(),
+		Expires: time.Unix(s.expires, 0),
+	})
+}
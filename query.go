@@ -0,0 +1,728 @@
+/*
+ * Adam - Adam's a Data Access Manager
+ * Copyright (C) 2021 Nicolò Santamaria
+ *
+ * Adam is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Adam is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The query index holds a key for each searchable field of each file made of
+// the name of the field, its value and the ID of the file, so that the files
+// matching a filter are found with a prefix scan. The numeric values are
+// shifted to be unsigned and hex encoded to a fixed width, so the keys of a
+// range share the prefix common to its bounds and are compared as strings.
+
+// ccQuery maps the field, value and ID of each file to the ID, and
+// queryVersionKey to the version of the format of the keys.
+var ccQuery *Cache
+
+// queryVersion changes along with the format of the keys of the query index,
+// which is rebuilt when it doesn't match.
+const queryVersion = "2"
+
+var queryVersionKey = []byte("\x00version")
+
+const (
+	fieldHash     = "sha256sum"
+	fieldMIME     = "mime"
+	fieldTag      = "tag"
+	fieldSize     = "size"
+	fieldCreated  = "created"
+	fieldModified = "modified"
+)
+
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+	// maxQueryFiles is the maximum number of files a query sorts in memory,
+	// the queries matching more must be sorted by path in ascending order,
+	// which is read in order from the path index.
+	maxQueryFiles = 10000
+)
+
+// QueryResponse represents the json returned after a /query call, cursor is
+// set if there are more results.
+type QueryResponse struct {
+	Base
+	Files  []File `json:"files"`
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// number returns n encoded to a fixed width so that the encoded numbers sort
+// like the numbers, the negative ones included.
+func number(n int64) string {
+	return fmt.Sprintf("%016x", uint64(n)^1<<63)
+}
+
+func queryKey(field, val, id string) []byte {
+	return []byte(field + "\x00" + val + "\x00" + id)
+}
+
+// queryKeys returns the keys of the query index of the file with the given
+// ID, checksum, Stat and Meta.
+func queryKeys(id, hash string, s *Stat, m *Meta) [][]byte {
+	var keys [][]byte
+
+	if hash != "" {
+		keys = append(keys, queryKey(fieldHash, hash, id))
+	}
+	if s != nil {
+		keys = append(keys,
+			queryKey(fieldMIME, s.MIME, id),
+			queryKey(fieldSize, number(s.Size), id),
+			queryKey(fieldCreated, number(s.Created.UnixNano()), id),
+			queryKey(fieldModified, number(s.Modified.UnixNano()), id),
+		)
+	}
+	if m != nil {
+		for _, t := range m.Tags {
+			keys = append(keys, queryKey(fieldTag, t, id))
+		}
+	}
+	return keys
+}
+
+// stagedKeys returns the keys of the query index of the file with the given
+// ID and path as seen by tx.
+func stagedKeys(tx *Txn, id, path string) ([][]byte, error) {
+	var (
+		s *Stat
+		m *Meta
+	)
+
+	hash, err := tx.Get(ccHash, []byte(path))
+	if err != nil {
+		return nil, err
+	}
+
+	if b, err := tx.Get(ccStat, []byte(id)); err != nil {
+		return nil, err
+	} else if b != nil {
+		s = &Stat{}
+		if err := json.Unmarshal(b, s); err != nil {
+			return nil, err
+		}
+	}
+
+	if b, err := tx.Get(ccMeta, []byte(id)); err != nil {
+		return nil, err
+	} else if b != nil {
+		m = &Meta{}
+		if err := json.Unmarshal(b, m); err != nil {
+			return nil, err
+		}
+	}
+	return queryKeys(id, string(hash), s, m), nil
+}
+
+// unindexQuery stages in tx the removal of the file with the given ID and
+// path from the query index, it must be called before its checksum, Stat or
+// Meta are changed.
+func unindexQuery(tx *Txn, id, path string) error {
+	keys, err := stagedKeys(tx, id, path)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		tx.Del(ccQuery, k)
+	}
+	return nil
+}
+
+// indexQuery stages in tx the addition of the file with the given ID and path
+// to the query index, it must be called after its checksum, Stat and Meta are
+// staged.
+func indexQuery(tx *Txn, id, path string) error {
+	keys, err := stagedKeys(tx, id, path)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		tx.Put(ccQuery, k, []byte(id))
+	}
+	return nil
+}
+
+// checkQueryIndex rebuilds ccQuery from the other caches if it's missing or
+// has an older format.
+func checkQueryIndex() error {
+	v, err := ccQuery.Get(queryVersionKey)
+	if err != nil {
+		return fmt.Errorf("checkQueryIndex ccQuery.Get: %w", err)
+	} else if string(v) == queryVersion {
+		return nil
+	}
+
+	var stale [][]byte
+	err = ccQuery.Fold(func(key, _ []byte) error {
+		stale = append(stale, key)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("checkQueryIndex ccQuery.Fold: %w", err)
+	}
+	for _, k := range stale {
+		if err := ccQuery.Del(k); err != nil {
+			return fmt.Errorf("checkQueryIndex ccQuery.Del: %w", err)
+		}
+	}
+
+	err = ccID.Fold(func(id, path []byte) error {
+		f, err := describe(string(id), string(path))
+		if err != nil {
+			return fmt.Errorf("checkQueryIndex describe: %w", err)
+		}
+
+		for _, k := range queryKeys(f.ID, f.Sha256sum, f.Stat, f.Meta) {
+			if err := ccQuery.Put(k, id); err != nil {
+				return fmt.Errorf("checkQueryIndex ccQuery.Put: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return ccQuery.Put(queryVersionKey, []byte(queryVersion))
+}
+
+// commonPrefix returns the longest common prefix of a and b.
+func commonPrefix(a, b string) string {
+	var i int
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return a[:i]
+}
+
+// idSet is a set of file IDs, the nil set stands for all the files.
+type idSet map[string]bool
+
+// intersect returns the IDs in both s and o.
+func (s idSet) intersect(o idSet) idSet {
+	if s == nil {
+		return o
+	}
+
+	var res = make(idSet)
+	for id := range o {
+		if s[id] {
+			res[id] = true
+		}
+	}
+	return res
+}
+
+// scanValue returns the IDs of the files whose field has the given value,
+// or starts with it if prefix is true.
+func scanValue(field, val string, prefix bool) (idSet, error) {
+	var (
+		ids = make(idSet)
+		p   = field + "\x00" + val
+	)
+	if !prefix {
+		p += "\x00"
+	}
+
+	err := ccQuery.Scan([]byte(p), func(_, id []byte) error {
+		ids[string(id)] = true
+		return nil
+	})
+	return ids, err
+}
+
+// scanRange returns the IDs of the files whose numeric field is within min
+// and max included, the bounds are ignored if nil.
+func scanRange(field string, min, max *int64) (idSet, error) {
+	var (
+		ids    = make(idSet)
+		lo, hi string
+		prefix = field + "\x00"
+	)
+	if min != nil {
+		lo = number(*min)
+	}
+	if max != nil {
+		hi = number(*max)
+	}
+	if min != nil && max != nil {
+		prefix += commonPrefix(lo, hi)
+	}
+
+	err := ccQuery.Scan([]byte(prefix), func(key, id []byte) error {
+		val := string(key[len(field)+1:])
+		if i := strings.IndexByte(val, 0); i >= 0 {
+			val = val[:i]
+		}
+		if (min == nil || val >= lo) && (max == nil || val <= hi) {
+			ids[string(id)] = true
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// query represents the filters, the order and the page of a /query call, the
+// nil bounds of the ranges are ignored.
+type query struct {
+	prefix     string
+	glob       string
+	hash       string
+	mime       string
+	tags       []string
+	size       [2]*int64
+	created    [2]*int64
+	modified   [2]*int64
+	sort       string
+	desc       bool
+	limit      int
+	cursorKey  string
+	cursorPath string
+	hasCursor  bool
+}
+
+// sortKey returns the value of the field f is sorted by as a string.
+func (q query) sortKey(f File) string {
+	if q.sort != "path" && f.Stat == nil {
+		return ""
+	}
+
+	switch q.sort {
+	case fieldSize:
+		return number(f.Size)
+	case fieldCreated:
+		return number(f.Created.UnixNano())
+	case fieldModified:
+		return number(f.Modified.UnixNano())
+	case fieldMIME:
+		return f.MIME
+	default:
+		return f.Path
+	}
+}
+
+// cursor returns the cursor pointing after f.
+func (q query) cursor(f File) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(q.sortKey(f) + "\x00" + f.Path))
+}
+
+// less reports whether the file with sort key ka and path pa comes before
+// the one with sort key kb and path pb, the ties are broken by path.
+func (q query) less(ka, pa, kb, pb string) bool {
+	if ka == kb {
+		ka, kb = pa, pb
+	}
+	if q.desc {
+		return ka > kb
+	}
+	return ka < kb
+}
+
+// after reports whether f comes after the cursor of q.
+func (q query) after(f File) bool {
+	return !q.hasCursor || q.less(q.cursorKey, q.cursorPath, q.sortKey(f), f.Path)
+}
+
+// candidates returns the IDs of the files matching the filters of q on the
+// query index or nil if it has none, the filters on the paths are left to
+// paths and keep.
+func (q query) candidates() (idSet, error) {
+	var (
+		ids  idSet
+		sets []func() (idSet, error)
+	)
+
+	if h := q.hash; h != "" {
+		sets = append(sets, func() (idSet, error) { return scanValue(fieldHash, h, false) })
+	}
+	if m := q.mime; m != "" {
+		// A wildcard subtype like image/* matches all the subtypes.
+		sets = append(sets, func() (idSet, error) {
+			if strings.HasSuffix(m, "/*") {
+				return scanValue(fieldMIME, strings.TrimSuffix(m, "*"), true)
+			}
+			return scanValue(fieldMIME, m, false)
+		})
+	}
+	for _, t := range q.tags {
+		t := t
+		sets = append(sets, func() (idSet, error) { return scanValue(fieldTag, t, false) })
+	}
+	for _, r := range []struct {
+		field  string
+		bounds [2]*int64
+	}{
+		{fieldSize, q.size},
+		{fieldCreated, q.created},
+		{fieldModified, q.modified},
+	} {
+		r := r
+		if r.bounds[0] != nil || r.bounds[1] != nil {
+			sets = append(sets, func() (idSet, error) { return scanRange(r.field, r.bounds[0], r.bounds[1]) })
+		}
+	}
+
+	for _, set := range sets {
+		s, err := set()
+		if err != nil {
+			return nil, err
+		}
+		if ids = ids.intersect(s); len(ids) == 0 {
+			break
+		}
+	}
+	return ids, nil
+}
+
+// root returns the directory or file the prefix of q stands for, or an empty
+// string if it has none.
+func (q query) root() string {
+	if q.prefix == "" {
+		return ""
+	}
+	if root := filepath.Clean(q.prefix); root != "." {
+		return root
+	}
+	return ""
+}
+
+// keep reports whether the file with the given ID and path matches the
+// filters of q on the path, is among ids unless it's nil and can be read by
+// the principal.
+func (q query) keep(p principal, ids idSet, id, path string) bool {
+	if ids != nil && !ids[id] {
+		return false
+	}
+	if root := q.root(); root != "" && !inTree(path, root) {
+		return false
+	}
+	if q.glob != "" {
+		if ok, _ := filepath.Match(q.glob, path); !ok {
+			return false
+		}
+	}
+	return p.can(permRead, path)
+}
+
+// paths calls fn in order with the paths starting from start that may match
+// the filters of q on the path, and their IDs.
+func (q query) paths(start string, fn func(path, id []byte) error) error {
+	var within string
+
+	if root := q.root(); root != "" {
+		// The root itself comes before all the paths inside it.
+		if root >= start {
+			id, err := ccPath.Get([]byte(root))
+			if err != nil {
+				return err
+			} else if id != nil {
+				if err := fn([]byte(root), id); errors.Is(err, ErrIterationDone) {
+					return nil
+				} else if err != nil {
+					return err
+				}
+			}
+		}
+		within = root + string(filepath.Separator)
+	}
+	if q.glob != "" {
+		// The part of the pattern before the first meta character is a
+		// prefix of all the matching paths.
+		p := q.glob
+		if i := strings.IndexAny(p, `*?[\`); i >= 0 {
+			p = p[:i]
+		}
+		if strings.HasPrefix(p, within) {
+			within = p
+		}
+	}
+
+	if start < within {
+		start = within
+	}
+	return ccPath.Seek([]byte(start), func(path, id []byte) error {
+		if !strings.HasPrefix(string(path), within) {
+			return ErrIterationDone
+		}
+		return fn(path, id)
+	})
+}
+
+// run returns the page of files matching q that the principal can read and
+// the cursor of the next page, which is empty if it's the last one.
+// The pages sorted by path in ascending order are read in order from the path
+// index, the others are sorted in memory as long as the query matches at most
+// maxQueryFiles files.
+func (q query) run(p principal) ([]File, string, error) {
+	var (
+		found []File
+		files = []File{}
+	)
+
+	ids, err := q.candidates()
+	if err != nil {
+		return nil, "", fmt.Errorf("query candidates: %w", err)
+	}
+	if q.sort == "path" && !q.desc && (ids == nil || len(ids) > maxQueryFiles) {
+		return q.walk(p, ids)
+	}
+	tooMany := errorf(
+		http.StatusBadRequest,
+		"the query matches more than %d files, add more filters or sort by path in ascending order",
+		maxQueryFiles,
+	)
+	if len(ids) > maxQueryFiles {
+		return nil, "", tooMany
+	}
+
+	if ids == nil {
+		err = q.paths("", func(path, id []byte) error {
+			if q.keep(p, nil, string(id), string(path)) {
+				found = append(found, File{ID: string(id), Path: string(path)})
+			}
+			if len(found) > maxQueryFiles {
+				return tooMany
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, "", fmt.Errorf("query paths: %w", err)
+		}
+	}
+	for id := range ids {
+		path, err := ccID.Get([]byte(id))
+		if err != nil {
+			return nil, "", fmt.Errorf("query ccID.Get: %w", err)
+		} else if path == nil {
+			// The file has been deleted in the meantime.
+			continue
+		}
+		if q.keep(p, nil, id, string(path)) {
+			found = append(found, File{ID: id, Path: string(path)})
+		}
+	}
+
+	for _, f := range found {
+		f, err := describe(f.ID, f.Path)
+		if err != nil {
+			return nil, "", fmt.Errorf("query describe: %w", err)
+		}
+		if q.after(f) {
+			files = append(files, f)
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return q.less(q.sortKey(files[i]), files[i].Path, q.sortKey(files[j]), files[j].Path)
+	})
+	return q.page(files)
+}
+
+// walk returns the page of q going through ccPath in order from the cursor
+// until the page is full, keeping only the files in ids unless it's nil.
+func (q query) walk(p principal, ids idSet) ([]File, string, error) {
+	var (
+		files = []File{}
+		start string
+	)
+
+	// The first path after the cursor is the one followed by a zero byte.
+	if q.hasCursor {
+		start = q.cursorPath + "\x00"
+	}
+
+	err := q.paths(start, func(path, id []byte) error {
+		if !q.keep(p, ids, string(id), string(path)) {
+			return nil
+		}
+
+		f, err := describe(string(id), string(path))
+		if err != nil {
+			return err
+		}
+		// One more file tells whether there's a next page.
+		if files = append(files, f); len(files) > q.limit {
+			return ErrIterationDone
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("query paths: %w", err)
+	}
+	return q.page(files)
+}
+
+// page trims the sorted files to the limit of q and returns them along with
+// the cursor of the next page, which is empty if it's the last one.
+func (q query) page(files []File) ([]File, string, error) {
+	if len(files) > q.limit {
+		files = files[:q.limit]
+		return files, q.cursor(files[len(files)-1]), nil
+	}
+	return files, "", nil
+}
+
+// parseInt parses the query parameter with the given name, if present.
+func parseInt(values url.Values, name string) (*int64, error) {
+	s := values.Get(name)
+	if s == "" {
+		return nil, nil
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return nil, errorf(http.StatusBadRequest, "invalid %s %q", name, s)
+	}
+	return &n, nil
+}
+
+// parseTime parses the RFC 3339 time in the query parameter with the given
+// name, if present, as nanoseconds since the epoch.
+func parseTime(values url.Values, name string) (*int64, error) {
+	s := values.Get(name)
+	if s == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "invalid %s %q", name, s)
+	}
+	n := t.UnixNano()
+	return &n, nil
+}
+
+// parseQuery returns the query in the query parameters of the request.
+func parseQuery(r *http.Request) (q query, err error) {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return q, errorf(http.StatusBadRequest, "%v", err)
+	}
+
+	q = query{
+		prefix: values.Get("prefix"),
+		glob:   values.Get("glob"),
+		hash:   values.Get("sha256sum"),
+		mime:   values.Get("mime"),
+		tags:   values["tag"],
+		sort:   values.Get("sort"),
+		limit:  defaultQueryLimit,
+	}
+
+	if q.glob != "" {
+		if _, err := filepath.Match(q.glob, ""); err != nil {
+			return q, errorf(http.StatusBadRequest, "invalid glob %q", q.glob)
+		}
+	}
+
+	switch q.sort {
+	case "":
+		q.sort = "path"
+	case "path", fieldSize, fieldCreated, fieldModified, fieldMIME:
+	default:
+		return q, errorf(http.StatusBadRequest, "invalid sort %q", q.sort)
+	}
+
+	switch o := values.Get("order"); o {
+	case "", "asc":
+	case "desc":
+		q.desc = true
+	default:
+		return q, errorf(http.StatusBadRequest, "invalid order %q", o)
+	}
+
+	if l := values.Get("limit"); l != "" {
+		if q.limit, err = strconv.Atoi(l); err != nil || q.limit < 1 || q.limit > maxQueryLimit {
+			return q, errorf(http.StatusBadRequest, "invalid limit %q", l)
+		}
+	}
+
+	if c := values.Get("cursor"); c != "" {
+		b, err := base64.RawURLEncoding.DecodeString(c)
+		i := strings.IndexByte(string(b), 0)
+		if err != nil || i < 0 {
+			return q, errorf(http.StatusBadRequest, "invalid cursor %q", c)
+		}
+		q.cursorKey, q.cursorPath, q.hasCursor = string(b[:i]), string(b[i+1:]), true
+	}
+
+	for _, p := range []struct {
+		dst   **int64
+		name  string
+		parse func(url.Values, string) (*int64, error)
+	}{
+		{&q.size[0], "min_size", parseInt},
+		{&q.size[1], "max_size", parseInt},
+		{&q.created[0], "created_after", parseTime},
+		{&q.created[1], "created_before", parseTime},
+		{&q.modified[0], "modified_after", parseTime},
+		{&q.modified[1], "modified_before", parseTime},
+	} {
+		if *p.dst, err = p.parse(values, p.name); err != nil {
+			return q, err
+		}
+	}
+	return q, nil
+}
+
+func handleQuery(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	if !allow(w, r, permRead) {
+		return
+	}
+
+	// The files the client isn't allowed to read are left out.
+	p, err := authenticate(r)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	q, err := parseQuery(r)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	files, cursor, err := q.run(p)
+	if err != nil {
+		log.Println("handleQuery", err)
+		fail(w, err)
+		return
+	}
+
+	reply(w, http.StatusOK, QueryResponse{
+		Base:   Base{OK: true},
+		Files:  files,
+		Cursor: cursor,
+	})
+}
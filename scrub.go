@@ -0,0 +1,259 @@
+/*
+ * Adam - Adam's a Data Access Manager
+ * Copyright (C) 2021 Nicolò Santamaria
+ *
+ * Adam is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Adam is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ccScrub maps the ID of each file to the result of its last verification.
+var ccScrub *Cache
+
+// ScrubResult represents the outcome of the verification of a file checksum.
+type ScrubResult struct {
+	ID         string    `json:"id"`
+	Path       string    `json:"path"`
+	Expected   string    `json:"expected"`
+	Actual     string    `json:"actual,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	OK         bool      `json:"ok"`
+	VerifiedAt time.Time `json:"verified_at"`
+}
+
+// ScrubResponse represents the json returned after a /scrub_report call.
+type ScrubResponse struct {
+	Base
+	Results []ScrubResult `json:"results"`
+}
+
+// scrubber re-verifies the checksums of the files at a throttled rate.
+type scrubber struct {
+	// IDs of the files still to be examined in the current pass.
+	queue []string
+	// Maximum number of files verified at each step.
+	rate int
+	// Minimum time between two verifications of the same file.
+	period time.Duration
+}
+
+// step verifies up to s.rate files whose last verification is older than
+// s.period, when all the files have been examined a new pass starts.
+func (s *scrubber) step() error {
+	if len(s.queue) == 0 {
+		if err := s.refill(); err != nil {
+			return fmt.Errorf("scrubber.step: %w", err)
+		}
+	}
+
+	for n := 0; n < s.rate && len(s.queue) > 0; {
+		id := s.queue[0]
+		s.queue = s.queue[1:]
+
+		last, err := scrubResult(id)
+		if err != nil {
+			return fmt.Errorf("scrubber.step: %w", err)
+		}
+		if last != nil && time.Since(last.VerifiedAt) < s.period {
+			continue
+		}
+
+		res, err := verify(id)
+		if err != nil {
+			return fmt.Errorf("scrubber.step: %w", err)
+		} else if res == nil {
+			// The file has been deleted in the meantime.
+			continue
+		}
+		n++
+
+		if !res.OK {
+			log.Printf("scrubber: %s (id %s) expected %s got %s %s", res.Path, res.ID, res.Expected, res.Actual, res.Error)
+		}
+
+		b, err := json.Marshal(res)
+		if err != nil {
+			return fmt.Errorf("scrubber.step json.Marshal: %w", err)
+		}
+		if err := ccScrub.Put([]byte(id), b); err != nil {
+			return fmt.Errorf("scrubber.step ccScrub.Put: %w", err)
+		}
+	}
+	return nil
+}
+
+// refill queues all the IDs for a new pass and prunes the results of the
+// files that don't exist anymore.
+func (s *scrubber) refill() error {
+	err := ccID.Fold(func(id, _ []byte) error {
+		s.queue = append(s.queue, string(id))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var stale [][]byte
+	err = ccScrub.Fold(func(id, _ []byte) error {
+		if p, err := ccID.Get(id); err != nil {
+			return err
+		} else if p == nil {
+			stale = append(stale, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range stale {
+		if err := ccScrub.Del(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verify rehashes the file with the given ID and compares the result with the
+// stored checksum, it returns nil if there's no file with such ID.
+func verify(id string) (*ScrubResult, error) {
+	path, err := ccID.Get([]byte(id))
+	if err != nil || path == nil {
+		return nil, err
+	}
+
+	hash, err := ccHash.Get(path)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &ScrubResult{
+		ID:         id,
+		Path:       string(path),
+		Expected:   string(hash),
+		VerifiedAt: time.Now(),
+	}
+
+	actual, err := hashFile(filepath.Join(cfg.BaseDir, string(path)))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if err != nil {
+		res.Error = "file not found"
+	}
+	res.Actual = actual
+	res.OK = err == nil && actual == res.Expected
+	return res, nil
+}
+
+// scrubResult returns the result of the last verification of the file with
+// the given ID or nil if it hasn't been verified yet.
+func scrubResult(id string) (*ScrubResult, error) {
+	b, err := ccScrub.Get([]byte(id))
+	if err != nil || b == nil {
+		return nil, err
+	}
+
+	var res ScrubResult
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// current reports whether the result still refers to the current content of
+// the file, results about overwritten or moved files are outdated.
+func (r ScrubResult) current() bool {
+	path, err := ccID.Get([]byte(r.ID))
+	if err != nil || string(path) != r.Path {
+		return false
+	}
+	hash, err := ccHash.Get(path)
+	return err == nil && string(hash) == r.Expected
+}
+
+func handleScrubReport(w http.ResponseWriter, r *http.Request) {
+	var results = []ScrubResult{}
+
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	if !allow(w, r, permRead) {
+		return
+	}
+
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		log.Println("handleScrubReport", "url.ParseQuery", err)
+		fail(w, errorf(http.StatusBadRequest, "%v", err))
+		return
+	}
+
+	// With the id query parameter the last result for that file is returned,
+	// otherwise all the current mismatches.
+	if id := values.Get("id"); id != "" {
+		res, err := scrubResult(id)
+		if err != nil {
+			log.Println("handleScrubReport", "scrubResult", err)
+			fail(w, err)
+			return
+		} else if res == nil {
+			fail(w, errorf(http.StatusNotFound, "file with id %s not verified yet", id))
+			return
+		}
+		if !allow(w, r, permRead, res.Path) {
+			return
+		}
+		results = append(results, *res)
+	} else {
+		// The files the client isn't allowed to read are left out.
+		p, err := authenticate(r)
+		if err != nil {
+			fail(w, err)
+			return
+		}
+
+		err = ccScrub.Fold(func(_, val []byte) error {
+			var res ScrubResult
+
+			if err := json.Unmarshal(val, &res); err != nil {
+				return err
+			}
+			if !res.OK && res.current() && p.can(permRead, res.Path) {
+				results = append(results, res)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Println("handleScrubReport", "ccScrub.Fold", err)
+			fail(w, err)
+			return
+		}
+	}
+
+	reply(w, http.StatusOK, ScrubResponse{
+		Base:    Base{OK: true},
+		Results: results,
+	})
+}
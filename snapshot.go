@@ -0,0 +1,585 @@
+/*
+ * Adam - Adam's a Data Access Manager
+ * Copyright (C) 2021 Nicolò Santamaria
+ *
+ * Adam is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Adam is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A snapshot is a copy of the base directory along with the IDs and the
+// checksums of its files at the time it was taken. The files are hard linked
+// where possible so that taking a snapshot is cheap, which is safe since Adam
+// never modifies a file in place but always replaces it: the files of the
+// snapshots share their inodes with the live files and with the blobs and
+// neither must ever be opened for writing.
+// The snapshots take no references on the blobs, releasing a blob only
+// removes its name and the content stays reachable from the snapshots, the
+// references are taken back by the restored files.
+
+// Snapshot represents a snapshot of the base directory.
+type Snapshot struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Count   int       `json:"count"`
+	Size    int64     `json:"size"`
+	Files   []File    `json:"files,omitempty"`
+}
+
+// SnapshotsResponse represents the json returned after a /snapshots call.
+type SnapshotsResponse struct {
+	Base
+	Snapshots []Snapshot `json:"snapshots"`
+}
+
+var snapshotName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+func snapshotsDir() string {
+	return filepath.Join(cfg.BaseDir, internalDir, "snapshots")
+}
+
+func snapshotDir(name string) string {
+	return filepath.Join(snapshotsDir(), name)
+}
+
+// snapshotTree returns the directory containing the files of the snapshot.
+func snapshotTree(name string) string {
+	return filepath.Join(snapshotDir(name), "tree")
+}
+
+func checkSnapshotName(name string) error {
+	if !snapshotName.MatchString(name) {
+		return errorf(http.StatusBadRequest, "invalid snapshot name %q", name)
+	}
+	return nil
+}
+
+// copyFile copies the content and the permissions of src into the new file dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// snapshotBatch is the number of files linked into a snapshot by each
+// transaction, the writes are suspended only for the time of a batch.
+const snapshotBatch = 256
+
+// mirrorTree recreates the directories of the tree rooted at src in dst and
+// returns the paths, relative to src, of the files and of the symbolic links
+// it contains. Adam's internal directory is left out.
+func mirrorTree(src, dst string) (paths []string, err error) {
+	err = filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == internalDir && d.IsDir() {
+			return filepath.SkipDir
+		}
+
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(filepath.Join(dst, rel), 0755)
+
+		case d.Type()&fs.ModeSymlink != 0, d.Type().IsRegular():
+			paths = append(paths, rel)
+		}
+		// Devices, sockets and pipes aren't content.
+		return nil
+	})
+	return paths, err
+}
+
+// clonePath recreates the file or the symbolic link at src in dst, hard
+// linking the files or copying them where hard links aren't supported, and
+// returns the size of the file. The paths that no longer exist or that are
+// no longer files or symbolic links are skipped.
+func clonePath(src, dst string) (int64, error) {
+	info, err := os.Lstat(src)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return 0, err
+		}
+		return 0, os.Symlink(link, dst)
+
+	case info.Mode().IsRegular():
+		if err := os.Link(src, dst); err != nil {
+			if err := copyFile(src, dst); err != nil {
+				return 0, err
+			}
+		}
+		return info.Size(), nil
+
+	default:
+		return 0, nil
+	}
+}
+
+// cloneTree recreates the tree rooted at src in dst and returns the total
+// size of the files, see mirrorTree and clonePath.
+func cloneTree(src, dst string) (size int64, err error) {
+	paths, err := mirrorTree(src, dst)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, p := range paths {
+		n, err := clonePath(filepath.Join(src, p), filepath.Join(dst, p))
+		if err != nil {
+			return size, err
+		}
+		size += n
+	}
+	return size, nil
+}
+
+// createSnapshot takes a new snapshot with the given name.
+// The base directory is listed without suspending the writes and its files
+// are then linked a batch at a time along with their IDs and checksums, so
+// the files written in the meantime may or may not be part of the snapshot
+// but each file always matches its ID and checksum.
+func createSnapshot(name string) (Snapshot, error) {
+	var s = Snapshot{
+		Name:    name,
+		Created: time.Now(),
+		Files:   []File{},
+	}
+
+	if err := checkSnapshotName(name); err != nil {
+		return s, fmt.Errorf("createSnapshot: %w", err)
+	}
+	if ok, err := exists(snapshotDir(name)); err != nil {
+		return s, fmt.Errorf("createSnapshot exists: %w", err)
+	} else if ok {
+		return s, fmt.Errorf("createSnapshot: %w", errorf(http.StatusConflict, "snapshot %s already exists", name))
+	}
+
+	var (
+		tmp  = tempPath()
+		tree = filepath.Join(tmp, "tree")
+	)
+	defer os.RemoveAll(tmp)
+
+	paths, err := mirrorTree(cfg.BaseDir, tree)
+	if err != nil {
+		return s, fmt.Errorf("createSnapshot mirrorTree: %w", err)
+	}
+
+	for len(paths) > 0 {
+		var batch = paths
+		if len(batch) > snapshotBatch {
+			batch = batch[:snapshotBatch]
+		}
+		paths = paths[len(batch):]
+
+		// The transactions have no operations, they're only used to keep
+		// the files of the batch and the caches still.
+		err := update(func(tx *Txn) error {
+			for _, p := range batch {
+				n, err := clonePath(filepath.Join(cfg.BaseDir, p), filepath.Join(tree, p))
+				if err != nil {
+					return err
+				}
+				s.Size += n
+
+				id, err := tx.Get(ccPath, []byte(p))
+				if err != nil {
+					return err
+				} else if id == nil {
+					continue
+				}
+				f, err := describe(string(id), p)
+				if err != nil {
+					return err
+				}
+				s.Files = append(s.Files, f)
+			}
+			return nil
+		})
+		if err != nil {
+			return s, fmt.Errorf("createSnapshot update: %w", err)
+		}
+	}
+
+	sort.Slice(s.Files, func(i, j int) bool {
+		return s.Files[i].Path < s.Files[j].Path
+	})
+	s.Count = len(s.Files)
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return s, fmt.Errorf("createSnapshot json.Marshal: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "snapshot.json"), b, 0644); err != nil {
+		return s, fmt.Errorf("createSnapshot os.WriteFile: %w", err)
+	}
+
+	// The name may have been taken in the meantime.
+	err = update(func(tx *Txn) error {
+		if ok, err := exists(snapshotDir(name)); err != nil {
+			return err
+		} else if ok {
+			return errorf(http.StatusConflict, "snapshot %s already exists", name)
+		}
+		return renameSync(tmp, snapshotDir(name))
+	})
+	if err != nil {
+		return s, fmt.Errorf("createSnapshot update: %w", err)
+	}
+	return s, nil
+}
+
+// loadSnapshot returns the snapshot with the given name or nil if it doesn't
+// exist.
+func loadSnapshot(name string) (*Snapshot, error) {
+	if checkSnapshotName(name) != nil {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(filepath.Join(snapshotDir(name), "snapshot.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var s Snapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// listSnapshots returns all the snapshots from the oldest without their files.
+func listSnapshots() ([]Snapshot, error) {
+	var list = []Snapshot{}
+
+	dirs, err := os.ReadDir(snapshotsDir())
+	if os.IsNotExist(err) {
+		return list, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, d := range dirs {
+		s, err := loadSnapshot(d.Name())
+		if err != nil {
+			return nil, err
+		} else if s != nil {
+			s.Files = nil
+			list = append(list, *s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list, nil
+}
+
+// deleteSnapshot removes the snapshot with the given name.
+func deleteSnapshot(name string) error {
+	if s, err := loadSnapshot(name); err != nil {
+		return fmt.Errorf("deleteSnapshot loadSnapshot: %w", err)
+	} else if s == nil {
+		return fmt.Errorf("deleteSnapshot: %w", errorf(http.StatusNotFound, "no snapshot named %s", name))
+	}
+
+	if err := removeSync(snapshotDir(name)); err != nil {
+		return fmt.Errorf("deleteSnapshot: %w", err)
+	}
+	return nil
+}
+
+// restoreSnapshot replaces the content of the base directory and the caches
+// with the ones of the snapshot with the given name. The replaced content is
+// moved to a single trash entry so that the restore can be undone.
+func restoreSnapshot(name string) (Snapshot, error) {
+	s, err := loadSnapshot(name)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("restoreSnapshot loadSnapshot: %w", err)
+	} else if s == nil {
+		return Snapshot{}, fmt.Errorf("restoreSnapshot: %w", errorf(http.StatusNotFound, "no snapshot named %s", name))
+	}
+
+	// The snapshot is cloned so that it stays untouched and can be restored
+	// again, the clone is moved into place by the transaction. Nothing writes
+	// to the snapshot, so it's cloned before suspending the writes.
+	clone := tempPath()
+	defer os.RemoveAll(clone)
+
+	if _, err := cloneTree(snapshotTree(name), clone); err != nil {
+		return Snapshot{}, fmt.Errorf("restoreSnapshot cloneTree: %w", err)
+	}
+
+	err = update(func(tx *Txn) error {
+		if err := moveToTrash(tx, "."); err != nil {
+			return err
+		}
+
+		restored, err := topLevel(clone)
+		if err != nil {
+			return err
+		}
+		for _, r := range restored {
+			tx.Rename(filepath.Join(clone, r), filepath.Join(cfg.BaseDir, r))
+		}
+
+		for _, f := range s.Files {
+			if err := retainBlob(tx, filepath.Join(clone, f.Path), f.Sha256sum); err != nil {
+				return err
+			}
+			if err := indexFile(tx, f); err != nil {
+				return err
+			}
+			err := logChange(tx, Change{Op: changeRestore, ID: f.ID, Path: f.Path, Sha256sum: f.Sha256sum})
+			if err != nil {
+				return err
+			}
+		}
+		tx.Remove(clone)
+		return nil
+	})
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("restoreSnapshot update: %w", err)
+	}
+
+	s.Files = nil
+	return *s, nil
+}
+
+// serveSnapshot serves the file of the snapshot with the ID in the query of
+// the request or the file or directory at path.
+func serveSnapshot(w http.ResponseWriter, r *http.Request, s *Snapshot, path string) {
+	if id := r.URL.Query().Get("id"); id != "" {
+		for _, f := range s.Files {
+			if f.ID == id {
+				if allow(w, r, permRead, f.Path) {
+					http.ServeFile(w, r, filepath.Join(snapshotTree(s.Name), f.Path))
+				}
+				return
+			}
+		}
+		fail(w, errorf(http.StatusNotFound, "no path with id %s in snapshot %s", id, s.Name))
+		return
+	}
+
+	if !allow(w, r, permRead, path) {
+		return
+	}
+	if path != "" {
+		if _, err := sanitizeIn(snapshotTree(s.Name), path); err != nil {
+			fail(w, err)
+			return
+		}
+	}
+
+	fs := http.FileServer(http.Dir(snapshotTree(s.Name)))
+	http.StripPrefix("/snapshots/"+s.Name, fs).ServeHTTP(w, r)
+}
+
+func handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	var (
+		rest       = strings.Trim(strings.TrimPrefix(r.URL.Path, "/snapshots"), "/")
+		name, path = rest, ""
+	)
+
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		name, path = rest[:i], rest[i+1:]
+	}
+
+	// The collection.
+	if name == "" {
+		if !checkMethod(w, r, http.MethodGet, http.MethodPost) {
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			if !allow(w, r, permRead) {
+				return
+			}
+			list, err := listSnapshots()
+			if err != nil {
+				log.Println("handleSnapshots", "listSnapshots", err)
+				fail(w, err)
+				return
+			}
+			reply(w, http.StatusOK, SnapshotsResponse{Base: Base{OK: true}, Snapshots: list})
+			return
+		}
+
+		if !allow(w, r, permAdmin) {
+			return
+		}
+		s, err := createSnapshot(r.URL.Query().Get("name"))
+		if err != nil {
+			log.Println("handleSnapshots", err)
+			fail(w, errors.Unwrap(err))
+			return
+		}
+		s.Files = nil
+		reply(w, http.StatusCreated, SnapshotsResponse{Base: Base{OK: true}, Snapshots: []Snapshot{s}})
+		return
+	}
+
+	if !checkMethod(w, r, http.MethodGet, http.MethodHead, http.MethodPost, http.MethodDelete) {
+		return
+	}
+
+	perm := permRead
+	if r.Method == http.MethodPost || r.Method == http.MethodDelete {
+		perm = permAdmin
+	}
+	if !allow(w, r, perm) {
+		return
+	}
+
+	s, err := loadSnapshot(name)
+	if err != nil {
+		log.Println("handleSnapshots", "loadSnapshot", err)
+		fail(w, err)
+		return
+	} else if s == nil {
+		fail(w, errorf(http.StatusNotFound, "no snapshot named %s", name))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		if path != "restore" {
+			fail(w, errorf(http.StatusNotFound, "unknown snapshot operation %q", path))
+			return
+		}
+		restored, err := restoreSnapshot(name)
+		if err != nil {
+			log.Println("handleSnapshots", err)
+			fail(w, errors.Unwrap(err))
+			return
+		}
+		reply(w, http.StatusOK, SnapshotsResponse{Base: Base{OK: true}, Snapshots: []Snapshot{restored}})
+
+	case http.MethodDelete:
+		if path != "" {
+			fail(w, errorf(http.StatusMethodNotAllowed, "only whole snapshots can be deleted"))
+			return
+		}
+		if err := deleteSnapshot(name); err != nil {
+			log.Println("handleSnapshots", err)
+			fail(w, errors.Unwrap(err))
+			return
+		}
+		reply(w, http.StatusOK, Base{OK: true})
+
+	default:
+		serveSnapshot(w, r, s, path)
+	}
+}
+
+func runSnapshot(args []string) int {
+	var usage = "usage: adam snapshot create|restore|delete <name> or adam snapshot list"
+
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	if args[0] == "list" {
+		list, err := listSnapshots()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "snapshot:", err)
+			return 2
+		}
+		for _, s := range list {
+			fmt.Printf("%s\t%s\t%d files\t%d bytes\n", s.Name, s.Created.Format(time.RFC3339), s.Count, s.Size)
+		}
+		return 0
+	}
+
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	var (
+		s   Snapshot
+		err error
+	)
+	switch name := args[1]; args[0] {
+	case "create":
+		s, err = createSnapshot(name)
+	case "restore":
+		s, err = restoreSnapshot(name)
+	case "delete":
+		s.Name, err = name, deleteSnapshot(name)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "snapshot:", err)
+		return 1
+	}
+	fmt.Printf("%s: %s\n", args[0], s.Name)
+	return 0
+}
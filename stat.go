@@ -0,0 +1,138 @@
+/*
+ * Adam - Adam's a Data Access Manager
+ * Copyright (C) 2021 Nicolò Santamaria
+ *
+ * Adam is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Adam is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ccStat maps the ID of each file to the Stat recorded when it was stored.
+var ccStat *Cache
+
+// detectMIME returns the media type of the file at path, guessed from the
+// extension of name or from the content if the extension is unknown.
+func detectMIME(name, path string) string {
+	if t := mime.TypeByExtension(filepath.Ext(name)); t != "" {
+		if mt, _, err := mime.ParseMediaType(t); err == nil {
+			return mt
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer f.Close()
+
+	// DetectContentType considers at most the first 512 bytes.
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	mt, _, _ := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	return mt
+}
+
+// uploader returns the name of the principal sending the request.
+func uploader(r *http.Request) string {
+	if p, err := authenticate(r); err == nil {
+		return p.name
+	}
+	return ""
+}
+
+// fileStat returns the Stat of the file with the given ID or nil if it wasn't
+// recorded, like for the files stored by older versions of Adam.
+func fileStat(id string) (*Stat, error) {
+	b, err := ccStat.Get([]byte(id))
+	if err != nil || b == nil {
+		return nil, err
+	}
+
+	var s Stat
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func handleStat(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	if !allow(w, r, permRead) {
+		return
+	}
+
+	// The file is identified either by the path after /stat/ or by the id
+	// query parameter.
+	var (
+		file File
+		err  error
+	)
+	if p := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/stat"), "/"); p != "" {
+		if file.Path, err = sanitize(p); err != nil {
+			fail(w, err)
+			return
+		}
+		if file.ID, err = findIDFromPath(file.Path); err != nil {
+			log.Println("handleStat", "findIDFromPath", err)
+			fail(w, err)
+			return
+		} else if file.ID == "" {
+			fail(w, errorf(http.StatusNotFound, "%s not found", file.Path))
+			return
+		}
+	} else {
+		if file.ID = r.URL.Query().Get("id"); file.ID == "" {
+			fail(w, errorf(http.StatusBadRequest, "missing id query parameter or path"))
+			return
+		}
+		path, err := ccID.Get([]byte(file.ID))
+		if err != nil {
+			log.Println("handleStat", "ccID.Get", err)
+			fail(w, err)
+			return
+		} else if path == nil {
+			fail(w, errorf(http.StatusNotFound, "no path with id %s", file.ID))
+			return
+		}
+		file.Path = string(path)
+	}
+
+	if !allow(w, r, permRead, file.Path) {
+		return
+	}
+
+	if file, err = describe(file.ID, file.Path); err != nil {
+		log.Println("handleStat", "describe", err)
+		fail(w, err)
+		return
+	}
+
+	reply(w, http.StatusOK, FileResponse{
+		Base: Base{OK: true},
+		File: &file,
+	})
+}
@@ -0,0 +1,341 @@
+/*
+ * Adam - Adam's a Data Access Manager
+ * Copyright (C) 2021 Nicolò Santamaria
+ *
+ * Adam is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Adam is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// jsonStream is a minimal json tokenizer that allows to read string values as
+// streams so that huge payloads never need to be kept entirely in memory.
+type jsonStream struct {
+	r *bufio.Reader
+}
+
+func newJSONStream(r io.Reader) jsonStream {
+	return jsonStream{bufio.NewReaderSize(r, 64*1024)}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// next consumes and returns the next byte that isn't whitespace.
+func (s jsonStream) next() (byte, error) {
+	for {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		if !isSpace(c) {
+			return c, nil
+		}
+	}
+}
+
+// peek returns the next byte that isn't whitespace without consuming it.
+func (s jsonStream) peek() (byte, error) {
+	c, err := s.next()
+	if err != nil {
+		return 0, err
+	}
+	return c, s.r.UnreadByte()
+}
+
+func (s jsonStream) expect(c byte) error {
+	if n, err := s.next(); err != nil {
+		return err
+	} else if n != c {
+		return fmt.Errorf("invalid json, expected %q got %q", c, n)
+	}
+	return nil
+}
+
+// array calls fn for each element of the json array, fn must consume the
+// whole element.
+func (s jsonStream) array(fn func() error) error {
+	if err := s.expect('['); err != nil {
+		return err
+	}
+	if c, err := s.peek(); err != nil {
+		return err
+	} else if c == ']' {
+		s.r.ReadByte()
+		return nil
+	}
+
+	for {
+		if err := fn(); err != nil {
+			return err
+		}
+
+		switch c, err := s.next(); {
+		case err != nil:
+			return err
+		case c == ']':
+			return nil
+		case c != ',':
+			return fmt.Errorf("invalid json, expected ',' or ']' got %q", c)
+		}
+	}
+}
+
+// object calls fn for each key of the json object, fn must consume the whole
+// value associated with the key.
+func (s jsonStream) object(fn func(key string) error) error {
+	if err := s.expect('{'); err != nil {
+		return err
+	}
+	if c, err := s.peek(); err != nil {
+		return err
+	} else if c == '}' {
+		s.r.ReadByte()
+		return nil
+	}
+
+	for {
+		key, err := s.readString()
+		if err != nil {
+			return err
+		}
+		if err := s.expect(':'); err != nil {
+			return err
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+
+		switch c, err := s.next(); {
+		case err != nil:
+			return err
+		case c == '}':
+			return nil
+		case c != ',':
+			return fmt.Errorf("invalid json, expected ',' or '}' got %q", c)
+		}
+	}
+}
+
+// stringReader returns a reader of the unescaped content of the next json
+// string, the reader must be read until io.EOF before continuing.
+func (s jsonStream) stringReader() (*jsonString, error) {
+	if err := s.expect('"'); err != nil {
+		return nil, err
+	}
+	return &jsonString{r: s.r}, nil
+}
+
+func (s jsonStream) readString() (string, error) {
+	sr, err := s.stringReader()
+	if err != nil {
+		return "", err
+	}
+	b, err := io.ReadAll(sr)
+	return string(b), err
+}
+
+// rawValue consumes and returns the next json value as it is.
+func (s jsonStream) rawValue() (json.RawMessage, error) {
+	var (
+		buf   bytes.Buffer
+		depth int
+		str   bool
+		esc   bool
+	)
+
+	// Skip the leading whitespace.
+	if _, err := s.peek(); err != nil {
+		return nil, err
+	}
+
+loop:
+	for {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			// A scalar value at the end of the input.
+			if err == io.EOF && depth == 0 && !str && buf.Len() > 0 {
+				break
+			}
+			return nil, unexpectedEOF(err)
+		}
+
+		if str {
+			buf.WriteByte(c)
+			switch {
+			case esc:
+				esc = false
+			case c == '\\':
+				esc = true
+			case c == '"':
+				str = false
+				if depth == 0 {
+					break loop
+				}
+			}
+			continue
+		}
+
+		if depth == 0 && buf.Len() > 0 && (c == ',' || c == '}' || c == ']' || isSpace(c)) {
+			// End of a scalar value.
+			s.r.UnreadByte()
+			break
+		}
+
+		buf.WriteByte(c)
+		switch c {
+		case '"':
+			str = true
+		case '{', '[':
+			depth++
+		case '}', ']':
+			if depth--; depth == 0 {
+				break loop
+			}
+		}
+	}
+
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("invalid json value %q", buf.String())
+	}
+	return buf.Bytes(), nil
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// jsonString is a reader that unescapes a json string on the fly.
+type jsonString struct {
+	r       *bufio.Reader
+	pending []byte
+	done    bool
+	// Number of bytes of the string read so far.
+	n int64
+	// The syntax errors are sticky since the rest of the string can't be
+	// told apart from what follows it.
+	err error
+}
+
+func (s *jsonString) Read(p []byte) (n int, err error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	for n < len(p) {
+		if len(s.pending) > 0 {
+			c := copy(p[n:], s.pending)
+			s.pending = s.pending[c:]
+			n += c
+			continue
+		}
+		if s.done {
+			break
+		}
+
+		c, err := s.r.ReadByte()
+		if err != nil {
+			s.err = unexpectedEOF(err)
+			return n, s.err
+		}
+
+		switch c {
+		case '"':
+			s.done = true
+		case '\\':
+			if s.pending, err = s.escape(); err != nil {
+				s.err = err
+				return n, err
+			}
+		default:
+			p[n] = c
+			n++
+		}
+	}
+
+	s.n += int64(n)
+	if n == 0 && s.done {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (s *jsonString) escape() ([]byte, error) {
+	c, err := s.r.ReadByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	switch c {
+	case '"', '\\', '/':
+		return []byte{c}, nil
+	case 'b':
+		return []byte{'\b'}, nil
+	case 'f':
+		return []byte{'\f'}, nil
+	case 'n':
+		return []byte{'\n'}, nil
+	case 'r':
+		return []byte{'\r'}, nil
+	case 't':
+		return []byte{'\t'}, nil
+	case 'u':
+		r, err := s.hex4()
+		if err != nil {
+			return nil, err
+		}
+		if utf16.IsSurrogate(r) {
+			if b, err := s.r.Peek(2); err == nil && string(b) == `\u` {
+				s.r.Discard(2)
+				r2, err := s.hex4()
+				if err != nil {
+					return nil, err
+				}
+				r = utf16.DecodeRune(r, r2)
+			}
+		}
+		var buf [utf8.UTFMax]byte
+		return buf[:utf8.EncodeRune(buf[:], r)], nil
+	default:
+		return nil, fmt.Errorf("invalid escape sequence \\%c", c)
+	}
+}
+
+func (s *jsonString) hex4() (rune, error) {
+	var b [4]byte
+
+	if _, err := io.ReadFull(s.r, b[:]); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	r, err := strconv.ParseUint(string(b[:]), 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid unicode escape \\u%s", b[:])
+	}
+	return rune(r), nil
+}
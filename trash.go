@@ -0,0 +1,475 @@
+/*
+ * Adam - Adam's a Data Access Manager
+ * Copyright (C) 2021 Nicolò Santamaria
+ *
+ * Adam is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Adam is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Deleting a path moves it to the trash along with the IDs, the checksums and
+// the versions of the files it contains, from where it can be restored until
+// it's purged either explicitly or when it's older than trash_expiry days.
+
+// ccTrash maps the ID of each trash entry to the TrashEntry.
+var ccTrash *Cache
+
+// TrashFile represents a deleted file in a trash entry.
+type TrashFile struct {
+	File
+	Versions []Version `json:"versions,omitempty"`
+}
+
+// TrashEntry represents a deleted path.
+type TrashEntry struct {
+	ID      string      `json:"id"`
+	Path    string      `json:"path"`
+	Deleted time.Time   `json:"deleted"`
+	Files   []TrashFile `json:"files"`
+}
+
+// TrashResponse represents the json returned after a /trash call.
+type TrashResponse struct {
+	Base
+	Entries []TrashEntry `json:"entries"`
+}
+
+func trashDir(tid string) string {
+	return filepath.Join(cfg.BaseDir, internalDir, "trash", tid)
+}
+
+// content returns where the file at path, contained in the deleted path, is
+// kept in the trash.
+func (e TrashEntry) content(path string) string {
+	if e.Path != "." {
+		path = strings.TrimPrefix(path, e.Path)
+	}
+	return filepath.Join(trashDir(e.ID), "content", path)
+}
+
+// roots returns the paths moved to the trash, that is the deleted path or the
+// top level paths of the base directory when the whole of it was replaced.
+func (e TrashEntry) roots() ([]string, error) {
+	if e.Path != "." {
+		return []string{e.Path}, nil
+	}
+	return topLevel(e.content("."))
+}
+
+// topLevel returns the names in dir except Adam's internal directory.
+func topLevel(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if e.Name() != internalDir {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+// versionsDir returns where the versions of the file with the given ID are
+// kept in the trash.
+func (e TrashEntry) versionsDir(id string) string {
+	return filepath.Join(trashDir(e.ID), "versions", filepath.Base(versionsDir(id)))
+}
+
+// moveToTrash stages the move of the path and of everything known about the
+// files it contains to a new trash entry, "." moves the whole content of the
+// base directory and does nothing if it's empty.
+func moveToTrash(tx *Txn, fpath string) error {
+	var roots = []string{fpath}
+	if fpath == "." {
+		var err error
+		if roots, err = topLevel(cfg.BaseDir); err != nil || len(roots) == 0 {
+			return err
+		}
+	}
+
+	files, err := subtree(fpath)
+	if err != nil {
+		return err
+	}
+
+	var e = TrashEntry{
+		ID:      uuid.New().String(),
+		Path:    fpath,
+		Deleted: time.Now(),
+		Files:   []TrashFile{},
+	}
+
+	for path, id := range files {
+		hash, err := tx.Get(ccHash, []byte(path))
+		if err != nil {
+			return err
+		}
+		vs, err := versions(id)
+		if err != nil {
+			return err
+		}
+		s, err := fileStat(id)
+		if err != nil {
+			return err
+		}
+		m, err := fileMeta(id)
+		if err != nil {
+			return err
+		}
+
+		e.Files = append(e.Files, TrashFile{
+			File:     File{Path: path, Sha256sum: string(hash), ID: id, Stat: s, Meta: m},
+			Versions: vs,
+		})
+		if err := unindexPath(tx, path, id); err != nil {
+			return err
+		}
+		err = logChange(tx, Change{Op: changeDelete, ID: id, Path: path, Sha256sum: string(hash)})
+		if err != nil {
+			return err
+		}
+
+		for _, v := range vs {
+			tx.Del(ccVersions, versionKey(id, v.Version))
+		}
+		if len(vs) > 0 {
+			tx.Rename(versionsDir(id), e.versionsDir(id))
+		}
+	}
+	sort.Slice(e.Files, func(i, j int) bool {
+		return e.Files[i].Path < e.Files[j].Path
+	})
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	for _, r := range roots {
+		tx.Rename(filepath.Join(cfg.BaseDir, r), e.content(r))
+	}
+	tx.Put(ccTrash, []byte(e.ID), b)
+	return nil
+}
+
+// trashEntry returns the trash entry with the given ID or nil if it doesn't
+// exist.
+func trashEntry(tid string) (*TrashEntry, error) {
+	b, err := ccTrash.Get([]byte(tid))
+	if err != nil || b == nil {
+		return nil, err
+	}
+
+	var e TrashEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// trashEntries returns all the trash entries from the most recent.
+func trashEntries() ([]TrashEntry, error) {
+	var entries = []TrashEntry{}
+
+	err := ccTrash.Fold(func(_, val []byte) error {
+		var e TrashEntry
+
+		if err := json.Unmarshal(val, &e); err != nil {
+			return err
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Deleted.After(entries[j].Deleted)
+	})
+	return entries, err
+}
+
+// restoreTrash moves the trash entry with the given ID back to its original
+// path along with the IDs, the checksums and the versions of its files.
+func restoreTrash(tid string) (TrashEntry, error) {
+	e, err := trashEntry(tid)
+	if err != nil {
+		return TrashEntry{}, fmt.Errorf("restoreTrash trashEntry: %w", err)
+	} else if e == nil {
+		return TrashEntry{}, fmt.Errorf("restoreTrash: %w", errorf(http.StatusNotFound, "no trash entry with id %s", tid))
+	}
+
+	roots, err := e.roots()
+	if err != nil {
+		return TrashEntry{}, fmt.Errorf("restoreTrash roots: %w", err)
+	}
+
+	for _, r := range roots {
+		// The symbolic links may have changed in the meantime.
+		if _, err := sanitize(r); err != nil {
+			return TrashEntry{}, fmt.Errorf("restoreTrash sanitize: %w", err)
+		}
+
+		if ok, err := exists(filepath.Join(cfg.BaseDir, r)); err != nil {
+			return TrashEntry{}, fmt.Errorf("restoreTrash exists: %w", err)
+		} else if ok {
+			return TrashEntry{}, fmt.Errorf("restoreTrash: %w", errorf(http.StatusConflict, "%s already exists", r))
+		}
+	}
+
+	err = update(func(tx *Txn) error {
+		for _, f := range e.Files {
+			if p, err := tx.Get(ccID, []byte(f.ID)); err != nil {
+				return err
+			} else if p != nil {
+				return errorf(http.StatusConflict, "id %s is used by %s", f.ID, p)
+			}
+			if vs, err := versions(f.ID); err != nil {
+				return err
+			} else if len(vs) > 0 {
+				return errorf(http.StatusConflict, "id %s already has a version history", f.ID)
+			}
+		}
+
+		for _, r := range roots {
+			tx.Rename(e.content(r), filepath.Join(cfg.BaseDir, r))
+		}
+		for _, f := range e.Files {
+			if err := indexFile(tx, f.File); err != nil {
+				return err
+			}
+			err := logChange(tx, Change{Op: changeRestore, ID: f.ID, Path: f.Path, Sha256sum: f.Sha256sum})
+			if err != nil {
+				return err
+			}
+
+			for _, v := range f.Versions {
+				b, err := json.Marshal(v)
+				if err != nil {
+					return err
+				}
+				tx.Put(ccVersions, versionKey(f.ID, v.Version), b)
+			}
+			if len(f.Versions) > 0 {
+				tx.Rename(e.versionsDir(f.ID), versionsDir(f.ID))
+			}
+		}
+		tx.Del(ccTrash, []byte(tid))
+		tx.Remove(trashDir(tid))
+		return nil
+	})
+	if err != nil {
+		return TrashEntry{}, fmt.Errorf("restoreTrash update: %w", err)
+	}
+	return *e, nil
+}
+
+// purgeTrash permanently deletes the trash entry with the given ID.
+func purgeTrash(tid string) error {
+	e, err := trashEntry(tid)
+	if err != nil {
+		return fmt.Errorf("purgeTrash trashEntry: %w", err)
+	} else if e == nil {
+		return fmt.Errorf("purgeTrash: %w", errorf(http.StatusNotFound, "no trash entry with id %s", tid))
+	}
+
+	err = update(func(tx *Txn) error {
+		var garbage []string
+
+		// The blobs linked to the deleted files and to their versions are
+		// released.
+		release := func(path, hash string) error {
+			blob, err := unlinkBlob(tx, path, hash)
+			if err == nil && blob != "" {
+				garbage = append(garbage, blob)
+			}
+			return err
+		}
+
+		for _, f := range e.Files {
+			if err := release(e.content(f.Path), f.Sha256sum); err != nil {
+				return err
+			}
+			for _, v := range f.Versions {
+				vpath := filepath.Join(e.versionsDir(f.ID), strconv.Itoa(v.Version))
+				if err := release(vpath, v.Sha256sum); err != nil {
+					return err
+				}
+			}
+		}
+
+		tx.Del(ccTrash, []byte(tid))
+		tx.Remove(trashDir(tid))
+		for _, g := range garbage {
+			tx.Remove(g)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("purgeTrash update: %w", err)
+	}
+	return nil
+}
+
+// expireTrash purges the trash entries older than trash_expiry days.
+func expireTrash() error {
+	if cfg.TrashExpiry <= 0 {
+		return nil
+	}
+
+	entries, err := trashEntries()
+	if err != nil {
+		return fmt.Errorf("expireTrash: %w", err)
+	}
+
+	var limit = time.Now().AddDate(0, 0, -cfg.TrashExpiry)
+	for _, e := range entries {
+		if e.Deleted.Before(limit) {
+			if err := purgeTrash(e.ID); err != nil {
+				return fmt.Errorf("expireTrash: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// trashQuery returns the trash entry with the ID in the query of the request.
+func trashQuery(r *http.Request) (*TrashEntry, error) {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "%v", err)
+	}
+
+	tid := values.Get("id")
+	if tid == "" {
+		return nil, errorf(http.StatusBadRequest, "missing id query parameter")
+	}
+
+	e, err := trashEntry(tid)
+	if err != nil {
+		return nil, err
+	} else if e == nil {
+		return nil, errorf(http.StatusNotFound, "no trash entry with id %s", tid)
+	}
+	return e, nil
+}
+
+func handleTrash(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	if !allow(w, r, permRead) {
+		return
+	}
+
+	// The entries the client isn't allowed to read are left out.
+	p, err := authenticate(r)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	entries, err := trashEntries()
+	if err != nil {
+		log.Println("handleTrash", "trashEntries", err)
+		fail(w, err)
+		return
+	}
+
+	var res = TrashResponse{
+		Base:    Base{OK: true},
+		Entries: []TrashEntry{},
+	}
+	for _, e := range entries {
+		if p.can(permRead, e.Path) {
+			res.Entries = append(res.Entries, e)
+		}
+	}
+	reply(w, http.StatusOK, res)
+}
+
+func handleTrashRestore(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	if !allow(w, r, permWrite) {
+		return
+	}
+
+	e, err := trashQuery(r)
+	if err != nil {
+		log.Println("handleTrashRestore", err)
+		fail(w, err)
+		return
+	}
+	if !allow(w, r, permWrite, e.Path) {
+		return
+	}
+
+	restored, err := restoreTrash(e.ID)
+	if err != nil {
+		log.Println("handleTrashRestore", err)
+		fail(w, errors.Unwrap(err))
+		return
+	}
+
+	reply(w, http.StatusOK, TrashResponse{
+		Base:    Base{OK: true},
+		Entries: []TrashEntry{restored},
+	})
+}
+
+func handleTrashPurge(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	if !allow(w, r, permDelete) {
+		return
+	}
+
+	e, err := trashQuery(r)
+	if err != nil {
+		log.Println("handleTrashPurge", err)
+		fail(w, err)
+		return
+	}
+	if !allow(w, r, permDelete, e.Path) {
+		return
+	}
+
+	if err := purgeTrash(e.ID); err != nil {
+		log.Println("handleTrashPurge", err)
+		fail(w, errors.Unwrap(err))
+		return
+	}
+	reply(w, http.StatusOK, Base{OK: true})
+}
@@ -0,0 +1,523 @@
+/*
+ * Adam - Adam's a Data Access Manager
+ * Copyright (C) 2021 Nicolò Santamaria
+ *
+ * Adam is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Adam is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Implementation of the tus resumable upload protocol version 1.0.0 with the
+// creation, creation-with-upload, termination and expiration extensions.
+// See https://tus.io/protocols/resumable-upload.html for the details.
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,creation-with-upload,termination,expiration"
+	tusPrefix     = "/tus/"
+	tusOctets     = "application/offset+octet-stream"
+)
+
+var (
+	tusMu   sync.Mutex
+	uploads = make(map[string]*tusUpload)
+)
+
+// tusUpload is the state of a resumable upload, it's saved to disk alongside
+// the uploaded data after each change.
+type tusUpload struct {
+	ID       string    `json:"id"`
+	Path     string    `json:"path"`
+	Length   int64     `json:"length"`
+	Offset   int64     `json:"offset"`
+	Metadata string    `json:"metadata,omitempty"`
+	Uploader string    `json:"uploader,omitempty"`
+	Hash     []byte    `json:"hash"`
+	Expires  time.Time `json:"expires"`
+	File     *File     `json:"file,omitempty"`
+	sync.Mutex
+}
+
+func uploadsDir() string {
+	return filepath.Join(cfg.BaseDir, internalDir, "uploads")
+}
+
+func (u *tusUpload) dataPath() string {
+	return filepath.Join(uploadsDir(), u.ID)
+}
+
+func (u *tusUpload) infoPath() string {
+	return filepath.Join(uploadsDir(), u.ID+".json")
+}
+
+func uploadExpiry() time.Time {
+	return time.Now().Add(time.Duration(cfg.UploadExpiry) * time.Hour)
+}
+
+// save writes the state of the upload to disk atomically.
+func (u *tusUpload) save() error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	tmp := u.infoPath() + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return renameSync(tmp, u.infoPath())
+}
+
+// remove deletes the upload data and state from disk.
+func (u *tusUpload) remove() {
+	for _, p := range []string{u.dataPath(), u.infoPath()} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			log.Println("tusUpload.remove", err)
+		}
+	}
+}
+
+func (u *tusUpload) hash() (hash.Hash, error) {
+	h := sha256.New()
+	if len(u.Hash) > 0 {
+		if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(u.Hash); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// write appends the content of r to the upload until its length is reached,
+// the state is updated with the bytes actually written even on errors.
+func (u *tusUpload) write(r io.Reader) error {
+	h, err := u.hash()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(u.dataPath(), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Drop whatever was written after the last saved state.
+	if err := f.Truncate(u.Offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(u.Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	n, werr := io.Copy(io.MultiWriter(f, h), io.LimitReader(r, u.Length-u.Offset))
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	if u.Hash, err = h.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+		return err
+	}
+	u.Offset += n
+	u.Expires = uploadExpiry()
+	if err := u.save(); err != nil {
+		return err
+	}
+	return werr
+}
+
+// finish stores the completed upload as any other file.
+func (u *tusUpload) finish() error {
+	h, err := u.hash()
+	if err != nil {
+		return err
+	}
+
+	file, err := put(u.Path, upload{
+		tmp:      u.dataPath(),
+		hash:     hex.EncodeToString(h.Sum(nil)),
+		size:     u.Length,
+		uploader: u.Uploader,
+	})
+	if err != nil {
+		return err
+	}
+
+	// The state is kept until it expires to let the clients retrieve the
+	// metadata of the file.
+	u.File = &file
+	return u.save()
+}
+
+// parseMetadata decodes the Upload-Metadata header.
+func parseMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+
+	for _, pair := range strings.Split(header, ",") {
+		kv := strings.Fields(pair)
+		switch len(kv) {
+		case 0:
+			continue
+		case 1:
+			meta[kv[0]] = ""
+		case 2:
+			v, err := base64.StdEncoding.DecodeString(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid metadata value for key %q", kv[0])
+			}
+			meta[kv[0]] = string(v)
+		default:
+			return nil, fmt.Errorf("invalid metadata pair %q", pair)
+		}
+	}
+	return meta, nil
+}
+
+func getUpload(id string) *tusUpload {
+	tusMu.Lock()
+	defer tusMu.Unlock()
+
+	u, ok := uploads[id]
+	if !ok || time.Now().After(u.Expires) {
+		return nil
+	}
+	return u
+}
+
+func dropUpload(u *tusUpload) {
+	tusMu.Lock()
+	delete(uploads, u.ID)
+	tusMu.Unlock()
+	u.remove()
+}
+
+// loadUploads loads the state of the uploads saved by a previous run.
+func loadUploads() error {
+	entries, err := os.ReadDir(uploadsDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("loadUploads os.ReadDir: %w", err)
+	}
+
+	tusMu.Lock()
+	defer tusMu.Unlock()
+
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+
+		b, err := os.ReadFile(filepath.Join(uploadsDir(), e.Name()))
+		if err != nil {
+			return fmt.Errorf("loadUploads os.ReadFile: %w", err)
+		}
+
+		var u tusUpload
+		if err := json.Unmarshal(b, &u); err != nil {
+			log.Println("loadUploads", e.Name(), err)
+			continue
+		}
+		uploads[u.ID] = &u
+	}
+	return nil
+}
+
+// expireUploads removes the expired uploads.
+func expireUploads() error {
+	var expired []*tusUpload
+
+	tusMu.Lock()
+	for id, u := range uploads {
+		if time.Now().After(u.Expires) {
+			expired = append(expired, u)
+			delete(uploads, id)
+		}
+	}
+	tusMu.Unlock()
+
+	for _, u := range expired {
+		u.Lock()
+		u.remove()
+		u.Unlock()
+	}
+	return nil
+}
+
+func tusError(w http.ResponseWriter, status int, format string, a ...interface{}) {
+	fail(w, errorf(status, format, a...))
+}
+
+func handleTus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if m := r.Header.Get("X-HTTP-Method-Override"); m != "" {
+		r.Method = m
+	}
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		if cfg.MaxUploadSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(cfg.MaxUploadSize, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if v := r.Header.Get("Tus-Resumable"); v != tusVersion && r.Method != http.MethodGet {
+		w.Header().Set("Tus-Version", tusVersion)
+		tusError(w, http.StatusPreconditionFailed, "unsupported tus version %q", v)
+		return
+	}
+
+	if !allow(w, r, permWrite) {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(tusPrefix, "/"))
+	id = strings.Trim(id, "/")
+
+	if id == "" {
+		if r.Method != http.MethodPost {
+			tusError(w, http.StatusMethodNotAllowed, "invalid request, expected POST got %s", r.Method)
+			return
+		}
+		tusCreate(w, r)
+		return
+	}
+
+	u := getUpload(id)
+	if u == nil {
+		tusError(w, http.StatusNotFound, "no upload with id %s", id)
+		return
+	}
+	if !allow(w, r, permWrite, u.Path) {
+		return
+	}
+
+	u.Lock()
+	defer u.Unlock()
+
+	switch r.Method {
+	case http.MethodHead:
+		tusHead(w, u)
+	case http.MethodPatch:
+		tusPatch(w, r, u)
+	case http.MethodDelete:
+		dropUpload(u)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		tusGet(w, u)
+	default:
+		tusError(w, http.StatusMethodNotAllowed, "invalid request method %s", r.Method)
+	}
+}
+
+func tusCreate(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		tusError(w, http.StatusBadRequest, "missing or invalid Upload-Length header")
+		return
+	}
+	if cfg.MaxUploadSize > 0 && length > cfg.MaxUploadSize {
+		tusError(w, http.StatusRequestEntityTooLarge, "upload exceeds the maximum size of %d bytes", cfg.MaxUploadSize)
+		return
+	}
+
+	meta, err := parseMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		tusError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	// The destination is either the path in the metadata or the file name
+	// inside the optional directory.
+	path := meta["path"]
+	if path == "" && meta["filename"] != "" {
+		path = filepath.Join(meta["dir"], filepath.Base(meta["filename"]))
+	}
+	if path == "" {
+		tusError(w, http.StatusBadRequest, "missing path or filename in Upload-Metadata")
+		return
+	}
+	if _, err := sanitize(path); err != nil {
+		fail(w, err)
+		return
+	}
+	if !allow(w, r, permWrite, path) {
+		return
+	}
+
+	u := &tusUpload{
+		ID:       uuid.New().String(),
+		Path:     path,
+		Length:   length,
+		Metadata: r.Header.Get("Upload-Metadata"),
+		Uploader: uploader(r),
+		Expires:  uploadExpiry(),
+	}
+
+	if err := os.MkdirAll(uploadsDir(), 0755); err != nil {
+		log.Println("tusCreate", "os.MkdirAll", err)
+		fail(w, err)
+		return
+	}
+	// The data file is created right away so that the empty uploads are
+	// complete as soon as they're created.
+	f, err := os.OpenFile(u.dataPath(), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		log.Println("tusCreate", "os.OpenFile", err)
+		fail(w, err)
+		return
+	}
+	f.Close()
+	if err := u.save(); err != nil {
+		log.Println("tusCreate", "tusUpload.save", err)
+		fail(w, err)
+		return
+	}
+
+	u.Lock()
+	defer u.Unlock()
+
+	tusMu.Lock()
+	uploads[u.ID] = u
+	tusMu.Unlock()
+
+	w.Header().Set("Location", tusPrefix+u.ID)
+	w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+
+	// creation-with-upload: the request can already contain some data.
+	if r.Header.Get("Content-Type") == tusOctets {
+		if err := u.write(r.Body); err != nil {
+			log.Println("tusCreate", "tusUpload.write", err)
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	}
+
+	if u.Offset == u.Length {
+		if err := u.finish(); err != nil {
+			log.Println("tusCreate", "tusUpload.finish", err)
+			dropUpload(u)
+			fail(w, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func tusHead(w http.ResponseWriter, u *tusUpload) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	if u.Metadata != "" {
+		w.Header().Set("Upload-Metadata", u.Metadata)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func tusPatch(w http.ResponseWriter, r *http.Request, u *tusUpload) {
+	if r.Header.Get("Content-Type") != tusOctets {
+		tusError(w, http.StatusUnsupportedMediaType, "expected Content-Type %s", tusOctets)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		tusError(w, http.StatusBadRequest, "missing or invalid Upload-Offset header")
+		return
+	}
+	if u.File != nil || offset != u.Offset {
+		tusError(w, http.StatusConflict, "upload offset is %d", u.Offset)
+		return
+	}
+	if r.ContentLength > u.Length-u.Offset {
+		tusError(w, http.StatusBadRequest, "the request exceeds the upload length")
+		return
+	}
+
+	if err := u.write(r.Body); err != nil {
+		log.Println("tusPatch", "tusUpload.write", err)
+		fail(w, err)
+		return
+	}
+
+	if u.Offset == u.Length {
+		if err := u.finish(); err != nil {
+			log.Println("tusPatch", "tusUpload.finish", err)
+			dropUpload(u)
+			fail(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusGet returns the metadata of the file once the upload is complete.
+func tusGet(w http.ResponseWriter, u *tusUpload) {
+	if u.File == nil {
+		tusError(w, http.StatusConflict, "upload not completed, offset is %d of %d", u.Offset, u.Length)
+		return
+	}
+
+	b, err := json.Marshal(PutResponse{
+		Base:  Base{OK: true},
+		Files: []File{*u.File},
+	})
+	if err != nil {
+		log.Println("tusGet", "json.Marshal", err)
+		fail(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintln(w, string(b))
+}
@@ -0,0 +1,252 @@
+/*
+ * Adam - Adam's a Data Access Manager
+ * Copyright (C) 2021 Nicolò Santamaria
+ *
+ * Adam is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Adam is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The v1 API addresses the objects either by path with /v1/files/<path> or
+// by ID with /v1/ids/<id> and manipulates them with the standard HTTP verbs.
+
+const (
+	v1Prefix = "/v1/"
+	v1Files  = v1Prefix + "files/"
+	v1IDs    = v1Prefix + "ids/"
+)
+
+// resource returns the path of the object addressed by the request and its
+// ID, which is empty if the path isn't tracked yet.
+func resource(r *http.Request) (path, id string, err error) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, v1Files):
+		path = strings.TrimPrefix(r.URL.Path, v1Files)
+		if path == "" {
+			return "", "", errorf(http.StatusBadRequest, "missing path")
+		}
+		if path, err = sanitize(path); err != nil {
+			return "", "", err
+		}
+		id, err = findIDFromPath(path)
+		return
+
+	case strings.HasPrefix(r.URL.Path, v1IDs):
+		id = strings.TrimPrefix(r.URL.Path, v1IDs)
+		if id == "" {
+			return "", "", errorf(http.StatusBadRequest, "missing id")
+		}
+
+		p, err := ccID.Get([]byte(id))
+		if err != nil {
+			return "", "", err
+		} else if p == nil {
+			return "", "", errorf(http.StatusNotFound, "no path with id %s", id)
+		}
+		return string(p), id, nil
+
+	default:
+		return "", "", errorf(http.StatusNotFound, "unknown resource %s", r.URL.Path)
+	}
+}
+
+// lookup returns the metadata of the file at path as stored in the caches.
+func lookup(path string) (File, error) {
+	id, err := findIDFromPath(path)
+	if err != nil {
+		return File{Path: path}, err
+	}
+	return describe(id, path)
+}
+
+// v1Perms maps the HTTP methods to the permissions they require.
+var v1Perms = map[string]Perm{
+	http.MethodGet:    permRead,
+	http.MethodHead:   permRead,
+	http.MethodPut:    permWrite,
+	http.MethodDelete: permDelete,
+	http.MethodPatch:  permMove,
+}
+
+func handleV1(w http.ResponseWriter, r *http.Request) {
+	allowed := []string{
+		http.MethodGet,
+		http.MethodHead,
+		http.MethodPut,
+		http.MethodDelete,
+		http.MethodPatch,
+	}
+	if !checkMethod(w, r, allowed...) {
+		return
+	}
+	if !allow(w, r, v1Perms[r.Method]) {
+		return
+	}
+
+	path, id, err := resource(r)
+	if err != nil {
+		log.Println("handleV1", "resource", err)
+		fail(w, err)
+		return
+	}
+	if !allow(w, r, v1Perms[r.Method], path) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		v1Get(w, r, path)
+	case http.MethodPut:
+		v1Put(w, r, path, id)
+	case http.MethodDelete:
+		v1Delete(w, path)
+	case http.MethodPatch:
+		v1Move(w, r, path)
+	}
+}
+
+// v1Get serves the content of the object with its ID and checksum in the
+// headers, the checksum is also the ETag for conditional requests.
+func v1Get(w http.ResponseWriter, r *http.Request, path string) {
+	f, err := os.Open(filepath.Join(cfg.BaseDir, path))
+	if errors.Is(err, os.ErrNotExist) {
+		fail(w, errorf(http.StatusNotFound, "%s not found", path))
+		return
+	} else if err != nil {
+		log.Println("v1Get", "os.Open", err)
+		fail(w, err)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		log.Println("v1Get", "os.File.Stat", err)
+		fail(w, err)
+		return
+	}
+	// The directories aren't objects, and listing them would skip the ACL
+	// checks on their content.
+	if info.IsDir() {
+		fail(w, errorf(http.StatusBadRequest, "%s is a directory", path))
+		return
+	}
+
+	file, err := lookup(path)
+	if err != nil {
+		log.Println("v1Get", "lookup", err)
+		fail(w, err)
+		return
+	}
+
+	if file.ID != "" {
+		w.Header().Set("X-Adam-Id", file.ID)
+	}
+	if file.Sha256sum != "" {
+		w.Header().Set("ETag", fmt.Sprintf("%q", file.Sha256sum))
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// v1Put stores the request body at path, replying 201 if the object is new.
+func v1Put(w http.ResponseWriter, r *http.Request, path, id string) {
+	u, err := receive(r.Body)
+	if err != nil {
+		log.Println("v1Put", "receive", err)
+		fail(w, err)
+		return
+	}
+	u.uploader = uploader(r)
+
+	var (
+		file   File
+		status = http.StatusOK
+	)
+
+	if id == "" {
+		status = http.StatusCreated
+		file, err = put(path, u)
+	} else {
+		file, err = saveData(id, path, u)
+	}
+	if err != nil {
+		log.Println("v1Put", err)
+		fail(w, errors.Unwrap(err))
+		return
+	}
+
+	if status == http.StatusCreated {
+		w.Header().Set("Location", v1IDs+file.ID)
+	}
+	reply(w, status, FileResponse{
+		Base: Base{OK: true},
+		File: &file,
+	})
+}
+
+func v1Delete(w http.ResponseWriter, path string) {
+	if err := del(path); err != nil {
+		log.Println("v1Delete", err)
+		fail(w, errors.Unwrap(err))
+		return
+	}
+	reply(w, http.StatusOK, Base{OK: true})
+}
+
+// v1Move moves the object to the path in the json body of the request.
+func v1Move(w http.ResponseWriter, r *http.Request, path string) {
+	var req MoveRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Println("v1Move", "json.Decoder.Decode", err)
+		fail(w, errorf(http.StatusBadRequest, "%v", err))
+		return
+	}
+	if req.Path == "" {
+		fail(w, errorf(http.StatusBadRequest, "missing path in request body"))
+		return
+	}
+	if !allow(w, r, permMove, req.Path) {
+		return
+	}
+
+	if err := move(path, req.Path); err != nil {
+		log.Println("v1Move", err)
+		fail(w, errors.Unwrap(err))
+		return
+	}
+
+	file, err := lookup(filepath.Clean(req.Path))
+	if err != nil {
+		log.Println("v1Move", "lookup", err)
+		fail(w, err)
+		return
+	}
+
+	reply(w, http.StatusOK, FileResponse{
+		Base: Base{OK: true},
+		File: &file,
+	})
+}
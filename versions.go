@@ -0,0 +1,323 @@
+/*
+ * Adam - Adam's a Data Access Manager
+ * Copyright (C) 2021 Nicolò Santamaria
+ *
+ * Adam is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Adam is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// When a file is overwritten its previous content is moved to the version
+// history of its ID, numbered from 1 in order of replacement, and the oldest
+// versions exceeding max_versions are dropped.
+
+// ccVersions maps the ID of each file followed by the number of each of its
+// past versions to the Version.
+var ccVersions *Cache
+
+// Version represents a past content of a file.
+type Version struct {
+	Version   int       `json:"version"`
+	Sha256sum string    `json:"sha256sum"`
+	Size      int64     `json:"size"`
+	Modified  time.Time `json:"modified"`
+	Replaced  time.Time `json:"replaced"`
+}
+
+// VersionsResponse represents the json returned after a /versions call.
+type VersionsResponse struct {
+	Base
+	ID       string    `json:"id"`
+	Path     string    `json:"path"`
+	Versions []Version `json:"versions"`
+}
+
+// versionsDir returns the directory containing the past versions of the file
+// with the given ID, since the IDs are chosen by the clients they're hashed to
+// be safely used as file names.
+func versionsDir(id string) string {
+	return filepath.Join(cfg.BaseDir, internalDir, "versions", fmt.Sprintf("%x", sha256.Sum256([]byte(id))))
+}
+
+func versionPath(id string, n int) string {
+	return filepath.Join(versionsDir(id), strconv.Itoa(n))
+}
+
+func versionKey(id string, n int) []byte {
+	return []byte(fmt.Sprintf("%s/%010d", id, n))
+}
+
+// versions returns the past versions of the file with the given ID from the
+// oldest to the newest.
+func versions(id string) ([]Version, error) {
+	var (
+		vs     []Version
+		prefix = []byte(id + "/")
+	)
+
+	err := ccVersions.Scan(prefix, func(key, val []byte) error {
+		var v Version
+
+		// The IDs of other files may start with the same prefix.
+		if len(key) != len(prefix)+10 {
+			return nil
+		}
+		if err := json.Unmarshal(val, &v); err != nil {
+			return err
+		}
+		vs = append(vs, v)
+		return nil
+	})
+
+	// Not every cache keeps the keys sorted.
+	sort.Slice(vs, func(i, j int) bool {
+		return vs[i].Version < vs[j].Version
+	})
+	return vs, err
+}
+
+// version returns the given version of the file with the given ID or nil if
+// it doesn't exist.
+func version(id string, n int) (*Version, error) {
+	b, err := ccVersions.Get(versionKey(id, n))
+	if err != nil || b == nil {
+		return nil, err
+	}
+
+	var v Version
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// archive stages the move of the current content of the file at path to its
+// version history and the pruning of the versions exceeding max_versions.
+// It returns the files to remove, whose removal must be staged by the caller
+// along with the other ones.
+func archive(tx *Txn, id, path, hash string, info os.FileInfo) ([]string, error) {
+	vs, err := versions(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var v = Version{
+		Version:   1,
+		Sha256sum: hash,
+		Size:      info.Size(),
+		Modified:  info.ModTime(),
+		Replaced:  time.Now(),
+	}
+	if len(vs) > 0 {
+		v.Version = vs[len(vs)-1].Version + 1
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	tx.Rename(path, versionPath(id, v.Version))
+	tx.Put(ccVersions, versionKey(id, v.Version), b)
+
+	var garbage []string
+	for cfg.MaxVersions > 0 && len(vs) >= cfg.MaxVersions {
+		old := vs[0]
+		vs = vs[1:]
+
+		vpath := versionPath(id, old.Version)
+		blob, err := unlinkBlob(tx, vpath, old.Sha256sum)
+		if err != nil {
+			return nil, err
+		} else if blob != "" {
+			garbage = append(garbage, blob)
+		}
+		tx.Del(ccVersions, versionKey(id, old.Version))
+		garbage = append(garbage, vpath)
+	}
+	return garbage, nil
+}
+
+// dropVersions stages the deletion of the version history of the file with
+// the given ID and returns the files to remove like archive.
+func dropVersions(tx *Txn, id string) ([]string, error) {
+	vs, err := versions(id)
+	if err != nil || len(vs) == 0 {
+		return nil, err
+	}
+
+	var garbage []string
+	for _, v := range vs {
+		blob, err := unlinkBlob(tx, versionPath(id, v.Version), v.Sha256sum)
+		if err != nil {
+			return nil, err
+		} else if blob != "" {
+			garbage = append(garbage, blob)
+		}
+		tx.Del(ccVersions, versionKey(id, v.Version))
+	}
+	return append(garbage, versionsDir(id)), nil
+}
+
+// rollback stores the given version of the file with the given ID as its
+// current content on behalf of uploader, the replaced content becomes a new
+// version.
+func rollback(id string, n int, uploader string) (File, error) {
+	path, err := ccID.Get([]byte(id))
+	if err != nil {
+		return File{}, fmt.Errorf("rollback ccID.Get: %w", err)
+	} else if path == nil {
+		return File{}, fmt.Errorf("rollback: %w", errorf(http.StatusNotFound, "no path with id %s", id))
+	}
+
+	v, err := version(id, n)
+	if err != nil {
+		return File{}, fmt.Errorf("rollback version: %w", err)
+	} else if v == nil {
+		return File{}, fmt.Errorf("rollback: %w", errorf(http.StatusNotFound, "no version %d of id %s", n, id))
+	}
+
+	f, err := os.Open(versionPath(id, n))
+	if err != nil {
+		return File{}, fmt.Errorf("rollback os.Open: %w", err)
+	}
+	defer f.Close()
+
+	// The content was already accepted once, so no size limit applies.
+	u, err := receiveMax(f, 0)
+	if err != nil {
+		return File{}, fmt.Errorf("rollback receive: %w", err)
+	}
+	u.uploader = uploader
+	return saveData(id, string(path), u)
+}
+
+// parseVersion returns the version number in the query parameter.
+func parseVersion(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, errorf(http.StatusBadRequest, "invalid version %q", s)
+	}
+	return n, nil
+}
+
+// versionQuery returns the ID, the path and the version number in the query
+// of the request, the version number is 0 if missing.
+func versionQuery(r *http.Request) (id, path string, n int, err error) {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return "", "", 0, errorf(http.StatusBadRequest, "%v", err)
+	}
+
+	if id = values.Get("id"); id == "" {
+		return "", "", 0, errorf(http.StatusBadRequest, "missing id query parameter")
+	}
+	if v := values.Get("version"); v != "" {
+		if n, err = parseVersion(v); err != nil {
+			return "", "", 0, err
+		}
+	}
+
+	p, err := ccID.Get([]byte(id))
+	if err != nil {
+		return "", "", 0, err
+	} else if p == nil {
+		return "", "", 0, errorf(http.StatusNotFound, "no path with id %s", id)
+	}
+	return id, string(p), n, nil
+}
+
+func handleVersions(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	if !allow(w, r, permRead) {
+		return
+	}
+
+	id, path, _, err := versionQuery(r)
+	if err != nil {
+		log.Println("handleVersions", err)
+		fail(w, err)
+		return
+	}
+	if !allow(w, r, permRead, path) {
+		return
+	}
+
+	vs, err := versions(id)
+	if err != nil {
+		log.Println("handleVersions", "versions", err)
+		fail(w, err)
+		return
+	}
+	if vs == nil {
+		vs = []Version{}
+	}
+
+	reply(w, http.StatusOK, VersionsResponse{
+		Base:     Base{OK: true},
+		ID:       id,
+		Path:     path,
+		Versions: vs,
+	})
+}
+
+func handleRollback(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	if !allow(w, r, permWrite) {
+		return
+	}
+
+	id, path, n, err := versionQuery(r)
+	if err != nil {
+		log.Println("handleRollback", err)
+		fail(w, err)
+		return
+	} else if n == 0 {
+		fail(w, errorf(http.StatusBadRequest, "missing version query parameter"))
+		return
+	}
+	if !allow(w, r, permWrite, path) {
+		return
+	}
+
+	file, err := rollback(id, n, uploader(r))
+	if err != nil {
+		log.Println("handleRollback", err)
+		fail(w, errors.Unwrap(err))
+		return
+	}
+
+	reply(w, http.StatusOK, PutResponse{
+		Base:  Base{OK: true},
+		Files: []File{file},
+	})
+}